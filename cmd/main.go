@@ -33,10 +33,12 @@ var tempBlocks []Block
 var candidateBlocks = make(chan Block)
 var announcements = make(chan string)
 
-var validators = make(map[string]int)
-var balances = make(map[string]int)
+var validators = make(map[string]Amount)
+var balances = make(map[balanceKey]Amount)
 var mutex = &sync.Mutex{}
 
+var DataDir = "data" // Directory the node keeps local data in, such as the contract cache
+
 var Difficulty = 4
 const blockReward = 50
 const totalSupply = 1000000 // Total supply of tokens
@@ -57,14 +59,66 @@ var GlobalConfig = map[string]int{
 	"reward":    50,
 	"supply":   1000000,
 	"shards":   10,
+	"txTTL":    100, // Number of blocks a new transaction stays valid for
+	"maxBlockDrift": 15, // Seconds a block timestamp may be ahead of the local clock
+	"channelChallengePeriod": 100, // Number of blocks a payment channel close can be disputed for
+	"maxGasLimit": 10000000, // Largest gas limit a transaction can set
+	"hostCallGas": 100, // Gas charged for every call into the host ABI
+	"storageByteGas": 10, // Gas charged per byte written to contract storage
+	"contractMemoryPages": 256, // Linear memory cap of a contract in 64 KiB pages
+	"contractCallDepth": 256, // Call stack cap of a contract
+	"contractValueSlots": 65536, // Value stack cap of a contract
+	"contractNestingDepth": 8, // Most contracts a contract call can nest through call_contract
+	"stateHistory": 100, // Number of past blocks contract queries can read the state of
+	"maxQueryGas": 1000000, // Largest gas limit of a contract query or transaction simulation
+	"maxContractSize": 512 * 1024, // Largest contract code in bytes
+	"maxContractFunctions": 1024, // Most functions a contract module can define
+	"contractCacheSize": 64, // Number of compiled contract modules kept in memory
+	"contractAOT": 0, // Set to 1 to compile contracts to native code, contract calls fail on a node without a C compiler
+	"storageDepositPerByte": 1, // Refundable deposit in the native coin per byte of contract storage
+	"denomRegistrationFee": 1000, // Native coin burned to register a denomination
 	// Add other parameters as needed
 }
 
 // Supported transaction types for the blockchain protocol
 var TransactionTypes = map[string]func(Transaction) error{
-	"transfer": TransferTransaction,
-	"contract": ContractTransaction,
-	"custom":   CustomTransaction, // New transaction type
+	"transfer":                 TransferTransaction,
+	"contract":                 ContractTransaction,
+	"custom":                   CustomTransaction, // New transaction type
+	"stake":                    StakeTransaction,
+	"unstake":                  UnstakeTransaction,
+	"vote":                     VoteTransaction,
+	"schedule":                 ScheduleTransaction,
+	"schedule_cancel":          CancelScheduleTransaction,
+	"fee_grant":                GrantFeeAllowanceTransaction,
+	"fee_revoke":               RevokeFeeAllowanceTransaction,
+	"authz_grant":              GrantAuthorizationTransaction,
+	"authz_revoke":             RevokeAuthorizationTransaction,
+	"denom_register":           RegisterDenomTransaction,
+	"vesting_create":           CreateVestingAccountTransaction,
+	"htlc_lock":                LockHTLCTransaction,
+	"htlc_claim":               ClaimHTLCTransaction,
+	"htlc_refund":              RefundHTLCTransaction,
+	"paychan_open":             OpenChannelTransaction,
+	"paychan_close":            CloseChannelTransaction,
+	"paychan_dispute":          DisputeChannelTransaction,
+	"paychan_settle":           SettleChannelTransaction,
+	"contract_deploy":          DeployContractTransaction,
+	"contract_migrate":         MigrateContractTransaction,
+	"contract_update_admin":    UpdateContractAdminTransaction,
+	"contract_clear_admin":     ClearContractAdminTransaction,
+	"token_create":             CreateTokenTransaction,
+	"token_mint":               MintTokenTransaction,
+	"token_set_mint_authority": SetMintAuthorityTokenTransaction,
+	"token_transfer":           TransferTokenTransaction,
+	"token_approve":            ApproveTokenTransaction,
+	"token_transfer_from":      TransferFromTokenTransaction,
+	"token_burn":               BurnTokenTransaction,
+	"nft_collection_create":    CreateCollectionTransaction,
+	"nft_mint":                 MintNFTTransaction,
+	"nft_transfer":             TransferNFTTransaction,
+	"nft_approve":              ApproveNFTTransaction,
+	"nft_burn":                 BurnNFTTransaction,
 	// Add other transaction types as needed
 }
 
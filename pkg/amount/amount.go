@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// An Amount is a non-negative quantity of tokens in the smallest unit of its denomination.
+// The zero value is zero. Amounts are immutable: arithmetic returns a new Amount and
+// reports an error on overflow or underflow instead of wrapping around.
+type Amount struct {
+	value *big.Int
+}
+
+// Largest representable amount, 2^256 - 1
+var maxAmount = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+var (
+	ErrAmountOverflow  = errors.New("amount overflow")
+	ErrAmountUnderflow = errors.New("amount underflow")
+)
+
+func NewAmount(n int64) Amount {
+	if n < 0 {
+		panic("negative amount")
+	}
+	return Amount{value: big.NewInt(n)}
+}
+
+// ParseAmount parses a decimal integer such as "1000000"
+func ParseAmount(s string) (Amount, error) {
+	value, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount: %s", s)
+	}
+	return newAmountFromBig(value)
+}
+
+// ParseDecimalAmount parses a decimal with up to the given number of fractional digits,
+// for example "1.5" with 6 decimals is 1500000 in the smallest unit
+func ParseDecimalAmount(s string, decimals int) (Amount, error) {
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+
+	if len(fraction) > decimals {
+		return Amount{}, fmt.Errorf("amount %s has more than %d decimals", s, decimals)
+	}
+
+	return ParseAmount(whole + fraction + strings.Repeat("0", decimals-len(fraction)))
+}
+
+func newAmountFromBig(value *big.Int) (Amount, error) {
+	if value.Sign() < 0 {
+		return Amount{}, ErrAmountUnderflow
+	}
+
+	if value.Cmp(maxAmount) > 0 {
+		return Amount{}, ErrAmountOverflow
+	}
+
+	return Amount{value: value}, nil
+}
+
+func (a Amount) bigInt() *big.Int {
+	if a.value == nil {
+		return new(big.Int)
+	}
+	return a.value
+}
+
+func (a Amount) IsZero() bool {
+	return a.bigInt().Sign() == 0
+}
+
+func (a Amount) Cmp(b Amount) int {
+	return a.bigInt().Cmp(b.bigInt())
+}
+
+func (a Amount) LT(b Amount) bool {
+	return a.Cmp(b) < 0
+}
+
+func (a Amount) Add(b Amount) (Amount, error) {
+	return newAmountFromBig(new(big.Int).Add(a.bigInt(), b.bigInt()))
+}
+
+func (a Amount) Sub(b Amount) (Amount, error) {
+	return newAmountFromBig(new(big.Int).Sub(a.bigInt(), b.bigInt()))
+}
+
+func (a Amount) MulInt(n int64) (Amount, error) {
+	return newAmountFromBig(new(big.Int).Mul(a.bigInt(), big.NewInt(n)))
+}
+
+// String formats the amount as a decimal integer in the smallest unit
+func (a Amount) String() string {
+	return a.bigInt().String()
+}
+
+// FormatDecimal formats the amount in whole units of a denomination with the given decimals
+func (a Amount) FormatDecimal(decimals int) string {
+	s := a.String()
+	if decimals == 0 {
+		return s
+	}
+
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+
+	whole, fraction := s[:len(s)-decimals], strings.TrimRight(s[len(s)-decimals:], "0")
+	if fraction == "" {
+		return whole
+	}
+	return whole + "." + fraction
+}
+
+// Amounts are encoded as decimal strings so clients do not lose precision
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Accept plain JSON numbers as well
+		s = string(data)
+	}
+
+	parsed, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+
+	*a = parsed
+	return nil
+}
+
+// dataAmount reads an amount from transaction data
+func dataAmount(data map[string]interface{}, key string) (Amount, bool) {
+	switch v := data[key].(type) {
+	case Amount:
+		return v, true
+	case string:
+		amount, err := ParseAmount(v)
+		return amount, err == nil
+	case int:
+		if v >= 0 {
+			return NewAmount(int64(v)), true
+		}
+	case float64:
+		if v >= 0 && v == float64(int64(v)) {
+			return NewAmount(int64(v)), true
+		}
+	}
+	return Amount{}, false
+}
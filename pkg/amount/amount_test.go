@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAmountArithmetic(t *testing.T) {
+	largest, err := ParseAmount("115792089237316195423570985008687907853269984665640564039457584007913129639935")
+	if err != nil {
+		t.Fatalf("ParseAmount(2^256-1) error = %v", err)
+	}
+
+	if _, err := largest.Add(NewAmount(1)); err != ErrAmountOverflow {
+		t.Errorf("largest + 1 error = %v, want ErrAmountOverflow", err)
+	}
+	if _, err := NewAmount(1).Sub(NewAmount(2)); err != ErrAmountUnderflow {
+		t.Errorf("1 - 2 error = %v, want ErrAmountUnderflow", err)
+	}
+	if _, err := largest.MulInt(2); err != ErrAmountOverflow {
+		t.Errorf("largest * 2 error = %v, want ErrAmountOverflow", err)
+	}
+
+	sum, err := Amount{}.Add(NewAmount(7))
+	if err != nil || sum.Cmp(NewAmount(7)) != 0 {
+		t.Errorf("0 + 7 = %s, %v", sum, err)
+	}
+
+	// Arithmetic never changes its operands
+	a := NewAmount(5)
+	a.Add(NewAmount(3))
+	if a.Cmp(NewAmount(5)) != 0 {
+		t.Errorf("operand changed to %s", a)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		decimals int
+		want     string
+		valid    bool
+	}{
+		{"1000", 0, "1000", true},
+		{"1.5", 6, "1500000", true},
+		{"0.000001", 6, "1", true},
+		{"2", 6, "2000000", true},
+		{"1.0000001", 6, "", false},
+		{"-1", 0, "", false},
+		{"1e3", 0, "", false},
+		{"", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDecimalAmount(tt.s, tt.decimals)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseDecimalAmount(%q, %d) error = %v, want valid %v", tt.s, tt.decimals, err, tt.valid)
+			continue
+		}
+		if tt.valid && got.String() != tt.want {
+			t.Errorf("ParseDecimalAmount(%q, %d) = %s, want %s", tt.s, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDecimal(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		decimals int
+		want     string
+	}{
+		{1500000, 6, "1.5"},
+		{1, 6, "0.000001"},
+		{2000000, 6, "2"},
+		{42, 0, "42"},
+	}
+
+	for _, tt := range tests {
+		if got := NewAmount(tt.amount).FormatDecimal(tt.decimals); got != tt.want {
+			t.Errorf("FormatDecimal(%d, %d) = %s, want %s", tt.amount, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	encoded, err := json.Marshal(NewAmount(12345))
+	if err != nil || string(encoded) != `"12345"` {
+		t.Errorf("json.Marshal() = %s, %v, want a decimal string", encoded, err)
+	}
+
+	var decoded Amount
+	for _, data := range []string{`"12345"`, `12345`} {
+		if err := json.Unmarshal([]byte(data), &decoded); err != nil || decoded.Cmp(NewAmount(12345)) != 0 {
+			t.Errorf("json.Unmarshal(%s) = %s, %v", data, decoded, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`"-1"`), &decoded); err == nil {
+		t.Error("json.Unmarshal() of a negative amount error = nil")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const defaultAuthorizationPeriod = 24 * 60 * 60 // Spend limits reset daily unless set otherwise
+
+// An Authorization lets the grantee execute one type of transaction on behalf of the granter.
+// The grantee signs the transaction as sender and names the granter in Transaction.Granter.
+type Authorization struct {
+	Granter     string
+	Grantee     string
+	MsgType     string // Key in TransactionTypes
+	SpendLimit  Amount // Amount the grantee may move per period, zero for no limit
+	Denom       string // Denomination of SpendLimit
+	Period      int64  // Length of a spend period in seconds
+	PeriodStart int64  // Unix time the current spend period started
+	PeriodSpent Amount // Amount moved during the current spend period
+	Expiration  int    // Last block height the authorization can be used in, 0 if it never expires
+}
+
+type authorizationKey struct {
+	Granter string
+	Grantee string
+	MsgType string
+}
+
+var authorizations = make(map[authorizationKey]Authorization)
+
+// Transaction types that move value they do not carry in their amount. A spend limit cannot
+// meter them, so they can only be authorized without one.
+var unmeteredAuthorizationTypes = map[string]bool{
+	"custom":         true, // Burns the "amount" data key
+	"fee_grant":      true, // Lets another account spend fees
+	"authz_grant":    true, // Passes on authorizations
+	"denom_register": true, // Burns the registration fee
+
+	// Token transactions take their amount from the "amount" data key
+	"token_create":             true,
+	"token_mint":               true,
+	"token_set_mint_authority": true,
+	"token_transfer":           true,
+	"token_approve":            true,
+	"token_transfer_from":      true,
+	"token_burn":               true,
+}
+
+// authorizedAmounts sums the amounts moved by a transaction per transaction type and denomination
+func authorizedAmounts(tx Transaction) (map[string]map[string]Amount, error) {
+	amounts := make(map[string]map[string]Amount)
+	add := func(msgType string, denom string, amount Amount) error {
+		if amounts[msgType] == nil {
+			amounts[msgType] = make(map[string]Amount)
+		}
+		return addAmount(amounts[msgType], denom, amount)
+	}
+
+	if len(tx.Messages) == 0 {
+		err := add(transactionType(tx), tx.Denom, tx.Amount)
+		return amounts, err
+	}
+
+	for _, msg := range tx.Messages {
+		err := add(msg.Type, msg.Denom, msg.Amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return amounts, nil
+}
+
+func checkAuthorization(tx Transaction, height int, now int64) error {
+	authorized, err := authorizedAmounts(tx)
+	if err != nil {
+		return err
+	}
+
+	for msgType, amounts := range authorized {
+		authorization, ok := authorizations[authorizationKey{Granter: tx.Granter, Grantee: tx.From, MsgType: msgType}]
+		if !ok {
+			return fmt.Errorf("not authorized to execute %s transactions for granter", msgType)
+		}
+
+		if authorization.Expiration != 0 && height > authorization.Expiration {
+			return errors.New("authorization has expired")
+		}
+
+		if authorization.SpendLimit.IsZero() {
+			continue
+		}
+
+		for denom, amount := range amounts {
+			if !amount.IsZero() && denom != authorization.Denom {
+				return fmt.Errorf("authorization only covers amounts in %s", authorization.Denom)
+			}
+		}
+
+		spent := authorization.PeriodSpent
+		if now >= authorization.PeriodStart+authorization.Period {
+			spent = Amount{}
+		}
+
+		spent, err = spent.Add(amounts[authorization.Denom])
+		if err != nil || authorization.SpendLimit.LT(spent) {
+			return fmt.Errorf("authorization spend limit exceeded for %s transactions", msgType)
+		}
+	}
+
+	return nil
+}
+
+func useAuthorization(tx Transaction, height int, now int64) error {
+	err := checkAuthorization(tx, height, now)
+	if err != nil {
+		return err
+	}
+
+	authorized, err := authorizedAmounts(tx)
+	if err != nil {
+		return err
+	}
+
+	for msgType, amounts := range authorized {
+		key := authorizationKey{Granter: tx.Granter, Grantee: tx.From, MsgType: msgType}
+		authorization := authorizations[key]
+
+		// Start a new spend period once the current one is over
+		if now >= authorization.PeriodStart+authorization.Period {
+			authorization.PeriodStart = now
+			authorization.PeriodSpent = Amount{}
+		}
+		authorization.PeriodSpent, err = authorization.PeriodSpent.Add(amounts[authorization.Denom])
+		if err != nil {
+			return err
+		}
+		journal.recordAuthorization(key)
+		authorizations[key] = authorization
+	}
+
+	return nil
+}
+
+// grantedTypes lists the transaction types a transaction grants authorizations for. They are
+// checked against TransactionTypes with the format of the transaction, as the grant handler
+// is itself in TransactionTypes and cannot refer to it.
+func grantedTypes(tx Transaction) []string {
+	var types []string
+	add := func(txType string, data map[string]interface{}) {
+		if txType == "authz_grant" {
+			msgType, _ := data["msgType"].(string)
+			types = append(types, msgType)
+		}
+	}
+
+	if len(tx.Messages) == 0 {
+		add(transactionType(tx), tx.Data)
+	}
+	for _, msg := range tx.Messages {
+		add(msg.Type, msg.Data)
+	}
+	return types
+}
+
+func GrantAuthorizationTransaction(tx Transaction) error {
+	if tx.To == "" || tx.To == tx.From {
+		return errors.New("invalid grantee")
+	}
+
+	msgType, ok := tx.Data["msgType"].(string)
+	if !ok || msgType == "" {
+		return errors.New("invalid message type")
+	}
+
+	// An authorization is unlimited only when it sets no spend limit, a limit it sets must be valid
+	var spendLimit Amount
+	if _, ok := tx.Data["spendLimit"]; ok {
+		spendLimit, ok = dataAmount(tx.Data, "spendLimit")
+		if !ok || spendLimit.IsZero() {
+			return errors.New("invalid spend limit")
+		}
+
+		if unmeteredAuthorizationTypes[msgType] {
+			return fmt.Errorf("%s transactions cannot be authorized with a spend limit", msgType)
+		}
+	}
+
+	expiration, _ := dataInt(tx.Data, "expiration")
+	period, ok := dataInt(tx.Data, "period")
+	if !ok {
+		period = defaultAuthorizationPeriod
+	}
+
+	if expiration < 0 || period <= 0 {
+		return errors.New("invalid authorization")
+	}
+
+	denom, _ := tx.Data["denom"].(string)
+	if !isKnownDenom(denom) {
+		return fmt.Errorf("unknown denomination: %s", denom)
+	}
+
+	// A new grant replaces the previous authorization for the same transaction type
+	key := authorizationKey{Granter: tx.From, Grantee: tx.To, MsgType: msgType}
+	journal.recordAuthorization(key)
+	authorizations[key] = Authorization{
+		Granter:    tx.From,
+		Grantee:    tx.To,
+		MsgType:    msgType,
+		SpendLimit: spendLimit,
+		Denom:      denomOrNative(denom),
+		Period:     period,
+		Expiration: int(expiration),
+	}
+
+	emitEvent(tx, "authz_grant", map[string]string{"granter": tx.From, "grantee": tx.To, "msgType": msgType})
+
+	return nil
+}
+
+func RevokeAuthorizationTransaction(tx Transaction) error {
+	msgType, ok := tx.Data["msgType"].(string)
+	if !ok {
+		return errors.New("invalid message type")
+	}
+
+	key := authorizationKey{Granter: tx.From, Grantee: tx.To, MsgType: msgType}
+	if _, ok := authorizations[key]; !ok {
+		return errors.New("authorization not found")
+	}
+
+	journal.recordAuthorization(key)
+	delete(authorizations, key)
+
+	emitEvent(tx, "authz_revoke", map[string]string{"granter": tx.From, "grantee": tx.To, "msgType": msgType})
+
+	return nil
+}
+
+// isValidAuthorization checks a transaction the sender executes on behalf of a granter
+func isValidAuthorization(tx Transaction) bool {
+	if tx.Granter == "" {
+		return true
+	}
+
+	err := checkAuthorization(tx, tx.blockHeight, tx.blockTime)
+	if err != nil {
+		return false
+	}
+	return true
+}
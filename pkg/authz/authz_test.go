@@ -0,0 +1,156 @@
+package main
+
+import "testing"
+
+func TestCheckAuthorization(t *testing.T) {
+	const now = 1000
+
+	onBehalf := func(amount int64) Transaction {
+		return Transaction{Type: "transfer", From: "bob", To: "carol", Granter: "alice", Amount: NewAmount(amount)}
+	}
+
+	tests := []struct {
+		name   string
+		auth   Authorization
+		tx     Transaction
+		height int
+		valid  bool
+	}{
+		{"no limit", Authorization{}, onBehalf(500), 1, true},
+		{"within period limit", Authorization{SpendLimit: NewAmount(100), Period: 60, PeriodStart: now, PeriodSpent: NewAmount(60)}, onBehalf(40), 1, true},
+		{"beyond period limit", Authorization{SpendLimit: NewAmount(100), Period: 60, PeriodStart: now, PeriodSpent: NewAmount(60)}, onBehalf(41), 1, false},
+		{"limit resets with a new period", Authorization{SpendLimit: NewAmount(100), Period: 60, PeriodStart: now - 60, PeriodSpent: NewAmount(100)}, onBehalf(100), 1, true},
+		{"at expiration", Authorization{Expiration: 10}, onBehalf(1), 10, true},
+		{"after expiration", Authorization{Expiration: 10}, onBehalf(1), 11, false},
+		{"other granter", Authorization{}, Transaction{Type: "transfer", From: "bob", To: "carol", Granter: "dave"}, 1, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		auth := tt.auth
+		auth.Granter, auth.Grantee, auth.MsgType, auth.Denom = "alice", "bob", "transfer", NativeDenom
+		authorizations[authorizationKey{Granter: "alice", Grantee: "bob", MsgType: "transfer"}] = auth
+
+		err := checkAuthorization(tt.tx, tt.height, now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: checkAuthorization() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestUseAuthorizationSpendPeriod(t *testing.T) {
+	resetState()
+	key := authorizationKey{Granter: "alice", Grantee: "bob", MsgType: "transfer"}
+	authorizations[key] = Authorization{Granter: "alice", Grantee: "bob", MsgType: "transfer", Denom: NativeDenom, SpendLimit: NewAmount(100), Period: 60}
+	tx := Transaction{Type: "transfer", From: "bob", To: "carol", Granter: "alice", Amount: NewAmount(60)}
+
+	tests := []struct {
+		name  string
+		now   int64
+		valid bool
+		spent int64
+	}{
+		{"first spend", 1000, true, 60},
+		{"over the limit in the same period", 1030, false, 60},
+		{"next period", 1060, true, 60},
+	}
+
+	for _, tt := range tests {
+		err := useAuthorization(tx, 1, tt.now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: useAuthorization() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if spent := authorizations[key].PeriodSpent; spent.Cmp(NewAmount(tt.spent)) != 0 {
+			t.Errorf("%s: period spent = %s, want %d", tt.name, spent, tt.spent)
+		}
+	}
+}
+
+func TestGrantAuthorizationTransaction(t *testing.T) {
+	grant := func(data map[string]interface{}) Transaction {
+		return Transaction{Type: "authz_grant", From: "alice", To: "bob", Data: data}
+	}
+
+	tests := []struct {
+		name    string
+		tx      Transaction
+		msgType string
+		limit   Amount
+		valid   bool
+	}{
+		{"no limit", grant(map[string]interface{}{"msgType": "transfer"}), "transfer", Amount{}, true},
+		{"spend limit", grant(map[string]interface{}{"msgType": "transfer", "spendLimit": "100"}), "transfer", NewAmount(100), true},
+		{"unmetered type without limit", grant(map[string]interface{}{"msgType": "custom"}), "custom", Amount{}, true},
+		{"unmetered type with limit", grant(map[string]interface{}{"msgType": "custom", "spendLimit": "100"}), "custom", Amount{}, false},
+		{"zero spend limit", grant(map[string]interface{}{"msgType": "transfer", "spendLimit": "0"}), "transfer", Amount{}, false},
+		{"malformed spend limit", grant(map[string]interface{}{"msgType": "transfer", "spendLimit": "lots"}), "transfer", Amount{}, false},
+		{"zero period", grant(map[string]interface{}{"msgType": "transfer", "period": 0}), "transfer", Amount{}, false},
+		{"no message type", grant(map[string]interface{}{}), "", Amount{}, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		err := GrantAuthorizationTransaction(tt.tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: GrantAuthorizationTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		auth, ok := authorizations[authorizationKey{Granter: "alice", Grantee: "bob", MsgType: tt.msgType}]
+		if ok != tt.valid {
+			t.Errorf("%s: authorization stored = %v, want %v", tt.name, ok, tt.valid)
+			continue
+		}
+		if ok && (auth.SpendLimit.Cmp(tt.limit) != 0 || auth.Period != defaultAuthorizationPeriod) {
+			t.Errorf("%s: authorization = %+v, want a spend limit of %s", tt.name, auth, tt.limit)
+		}
+	}
+}
+
+func TestGrantedTypesMustBeKnown(t *testing.T) {
+	grant := func(msgType string) Transaction {
+		return Transaction{Type: "authz_grant", From: "alice", To: "bob", Data: map[string]interface{}{"msgType": msgType}}
+	}
+
+	if !isTransactionWellFormed(grant("transfer")) {
+		t.Error("grant for a known type is malformed")
+	}
+	if isTransactionWellFormed(grant("teleport")) {
+		t.Error("grant for an unknown type is well formed")
+	}
+
+	nested := Transaction{From: "alice", Messages: []Message{
+		{Type: "transfer", To: "bob", Amount: NewAmount(1)},
+		{Type: "authz_grant", To: "bob", Data: map[string]interface{}{"msgType": "teleport"}},
+	}}
+	if isTransactionWellFormed(nested) {
+		t.Error("grant for an unknown type inside a message is well formed")
+	}
+}
+
+func TestExecuteOnBehalfOfGranter(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	addBalance("bob", NativeDenom, NewAmount(5))
+	key := authorizationKey{Granter: "alice", Grantee: "bob", MsgType: "transfer"}
+	authorizations[key] = Authorization{Granter: "alice", Grantee: "bob", MsgType: "transfer", Denom: NativeDenom, SpendLimit: NewAmount(50), Period: 60}
+
+	tx := Transaction{From: "bob", To: "carol", Granter: "alice", Amount: NewAmount(30), Fee: NewAmount(5)}
+	receipt := executeTransaction(tx, 1, 1000)
+	if receipt.Status != ReceiptSuccess {
+		t.Fatalf("status = %v, error = %q", receipt.Status, receipt.Error)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(70)) != 0 {
+		t.Errorf("granter balance = %s, want 70", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("grantee balance = %s, want the fee paid", balance)
+	}
+	if balance := getBalance("carol", NativeDenom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("recipient balance = %s, want 30", balance)
+	}
+	if spent := authorizations[key].PeriodSpent; spent.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("period spent = %s, want 30", spent)
+	}
+}
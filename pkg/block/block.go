@@ -4,65 +4,260 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"time"
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 )
 
 type Block struct {
 	Index        int
-	Timestamp    string
+	Timestamp    string // RFC 3339, transactions execute at this time
 	Transactions []Transaction
 	Hash         string
 	PrevHash     string
 	Nonce        string
-	Reward       int
+	Reward       Amount
+	Receipts     []Receipt
+	ReceiptsRoot string
+	Validator    string  // Account the reward and the fees of the block are paid to
+	Events       []Event // Events of the block itself, such as executed scheduled transfers, set by executing it
+
+	state *stateSnapshot // State after executing the block, set by verifyBlock and installed by commitBlock
 }
 
 func calculateHash(block Block) string {
-	record := string(block.Index) + block.Timestamp + fmt.Sprintf("%v", block.Transactions) + block.PrevHash + block.Nonce
+	record := string(block.Index) + block.Timestamp + fmt.Sprintf("%v", block.Transactions) + block.PrevHash + block.Nonce + block.ReceiptsRoot + block.Validator
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
 	return hex.EncodeToString(hashed)
 }
 
+// createBlock executes the transactions into a new block on top of the live state, which
+// is then rolled back. Transactions that cannot be included are left out. The block is
+// verified and committed like a block received from a peer.
 func createBlock(oldBlock Block, Transactions []Transaction, validator string) (Block, error) {
 	var newBlock Block
 
-	t := time.Now()
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	snapshot := takeSnapshot()
+	defer restoreSnapshot(snapshot)
+
+	// Blocks are at least a second apart, so each one is later than its parent
+	t := time.Now().UTC().Truncate(time.Second)
+	if parent, err := blockTime(oldBlock); err == nil && t.Unix() <= parent {
+		t = time.Unix(parent+1, 0).UTC()
+	}
 
 	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
-	newBlock.Transactions = Transactions
+	newBlock.Timestamp = t.Format(time.RFC3339)
 	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Hash = calculateHash(newBlock)
-	newBlock.Reward = blockReward
+	newBlock.Reward = NewAmount(blockReward)
+	newBlock.Validator = validator
 
-	// The validator gets a reward
-	balances[validator] += blockReward
+	var err error
+	newBlock.Transactions, newBlock.Receipts, newBlock.Events, err = executeBlock(newBlock, Transactions)
+	if err != nil {
+		return newBlock, err
+	}
+	newBlock.ReceiptsRoot = calculateReceiptsRoot(newBlock.Receipts)
+	newBlock.Hash = calculateHash(newBlock)
 
 	return newBlock, nil
 }
 
-func isBlockValid(newBlock, oldBlock Block) bool {
+// executeBlock executes transactions against the live state at the height and time of a
+// block, runs the scheduled transfers that have come due and pays the validator the
+// reward and the fees. It returns the transactions that go into the block with their
+// receipts, and the events of the block itself. Invalid transactions had no effect and
+// are left out, a failed transaction only pays its fee.
+func executeBlock(block Block, txs []Transaction) ([]Transaction, []Receipt, []Event, error) {
+	now, err := blockTime(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var included []Transaction
+	var receipts []Receipt
+	fees := make(map[string]Amount)
+	for i, receipt := range executeTransactions(txs, block.Index, now) {
+		if receipt.Status == ReceiptInvalid {
+			continue
+		}
+		included = append(included, txs[i])
+		receipts = append(receipts, receipt)
+
+		err = addAmount(fees, receipt.FeeDenom, receipt.Fee)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Execute the scheduled transfers that have come due with this block
+	events := runScheduledTransfers(block.Index, now)
+
+	// The validator gets a reward and the fees of the block
+	err = addAmount(fees, NativeDenom, block.Reward)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for denom, amount := range fees {
+		err = addBalance(block.Validator, denom, amount)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return included, receipts, events, nil
+}
+
+// verifyBlock re-executes a block on top of the state of its parent, which must be the
+// head of the chain, and checks the result against the receipts root of the block. The
+// live state is left untouched: the block is returned with the state after it, ready
+// for commitBlock.
+func verifyBlock(newBlock, oldBlock Block) (Block, error) {
 	if oldBlock.Index+1 != newBlock.Index {
-		return false
+		return newBlock, errors.New("block does not follow its parent")
 	}
 
 	if oldBlock.Hash != newBlock.PrevHash {
-		return false
+		return newBlock, errors.New("previous hash does not match the parent")
 	}
 
 	if calculateHash(newBlock) != newBlock.Hash {
-		return false
+		return newBlock, errors.New("invalid block hash")
 	}
 
-	for _, tx := range newBlock.Transactions {
-		if !isTransactionValid(tx) {
-			return false
+	err := checkBlockTime(newBlock, oldBlock)
+	if err != nil {
+		return newBlock, err
+	}
+
+	if newBlock.Reward.Cmp(NewAmount(blockReward)) != 0 {
+		return newBlock, errors.New("invalid block reward")
+	}
+
+	if len(newBlock.Receipts) != len(newBlock.Transactions) || calculateReceiptsRoot(newBlock.Receipts) != newBlock.ReceiptsRoot {
+		return newBlock, errors.New("receipts do not match the receipts root")
+	}
+
+	for _, valid := range verifySignatures(newBlock.Transactions) {
+		if !valid {
+			return newBlock, errors.New("block includes a transaction with an invalid signature")
 		}
 	}
 
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if !isHead(oldBlock) {
+		return newBlock, errors.New("parent is not the head of the chain")
+	}
+
+	snapshot := takeSnapshot()
+	defer restoreSnapshot(snapshot)
+
+	included, receipts, events, err := executeBlock(newBlock, newBlock.Transactions)
+	if err != nil {
+		return newBlock, err
+	}
+
+	if len(included) != len(newBlock.Transactions) {
+		return newBlock, errors.New("block includes invalid transactions")
+	}
+
+	if calculateReceiptsRoot(receipts) != newBlock.ReceiptsRoot {
+		return newBlock, errors.New("receipts root does not match the executed block")
+	}
+
+	// Block events are taken from the execution, never from the peer
+	newBlock.Events = events
+	state := takeSnapshot()
+	newBlock.state = &state
+
+	return newBlock, nil
+}
+
+// commitBlock appends a verified block to the chain, installs its state and indexes its
+// receipts in one step. Its parent must still be the head, otherwise another block was
+// committed since it was verified and its state would overwrite that block's.
+func commitBlock(block Block) error {
+	if block.state == nil {
+		return errors.New("block has not been verified")
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if len(Blockchain) == 0 || Blockchain[len(Blockchain)-1].Hash != block.PrevHash {
+		return errors.New("parent is not the head of the chain")
+	}
+
+	recordState(block.Index, *block.state)
+	restoreSnapshot(*block.state)
+	indexReceipts(block)
+	Blockchain = append(Blockchain, block)
+
+	return nil
+}
+
+// isHead reports whether a block is the last block of the chain, stateMutex must be held
+func isHead(block Block) bool {
+	return len(Blockchain) > 0 && Blockchain[len(Blockchain)-1].Hash == block.Hash
+}
+
+// checkBlockTime checks that a block is later than its parent and not further ahead of the
+// local clock than maxBlockDrift. Vesting, validity windows, scheduled transfers and spend
+// periods all run on block time, so a proposer must not be able to move it forward at will.
+func checkBlockTime(newBlock, oldBlock Block) error {
+	now, err := blockTime(newBlock)
+	if err != nil {
+		return errors.New("invalid block timestamp")
+	}
+
+	parent, err := blockTime(oldBlock)
+	if err != nil {
+		return errors.New("invalid parent block timestamp")
+	}
+
+	if now <= parent {
+		return errors.New("block timestamp is not after its parent")
+	}
+
+	if now > time.Now().Unix()+int64(GlobalConfig["maxBlockDrift"]) {
+		return errors.New("block timestamp is too far in the future")
+	}
+
+	return nil
+}
+
+// blockTime returns the Unix time of a block. Execution reads the time from the block
+// instead of the local clock, so every node gets the same result.
+func blockTime(block Block) (int64, error) {
+	t, err := time.Parse(time.RFC3339, block.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+func currentHeight() int {
+	if len(Blockchain) == 0 {
+		return 0
+	}
+	return Blockchain[len(Blockchain)-1].Index
+}
+
+func isBlockValid(newBlock, oldBlock Block) bool {
+	_, err := verifyBlock(newBlock, oldBlock)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
 	return true
 }
 
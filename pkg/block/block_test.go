@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// blockAt returns a block at the given height and Unix time
+func blockAt(index int, unix int64) Block {
+	return Block{Index: index, Timestamp: time.Unix(unix, 0).UTC().Format(time.RFC3339), Hash: "parent"}
+}
+
+func TestCheckBlockTime(t *testing.T) {
+	now := time.Now().Unix()
+	parent := blockAt(1, now-60)
+	drift := int64(GlobalConfig["maxBlockDrift"])
+
+	tests := []struct {
+		name  string
+		block Block
+		valid bool
+	}{
+		{"after the parent", blockAt(2, now-59), true},
+		{"at the drift limit", blockAt(2, now+drift-1), true},
+		{"same time as the parent", blockAt(2, now-60), false},
+		{"before the parent", blockAt(2, now-61), false},
+		{"beyond the drift limit", blockAt(2, now+drift+60), false},
+		{"malformed timestamp", Block{Index: 2, Timestamp: "yesterday"}, false},
+	}
+
+	for _, tt := range tests {
+		err := checkBlockTime(tt.block, parent)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: checkBlockTime() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestExecuteBlockRunsScheduledTransfers(t *testing.T) {
+	resetState()
+	scheduledTransfers = []ScheduledTransfer{
+		{ID: "due", From: "alice", To: "bob", Amount: NewAmount(10), Denom: NativeDenom, ExecuteAtTime: 1000},
+		{ID: "later", From: "alice", To: "bob", Amount: NewAmount(20), Denom: NativeDenom, ExecuteAtHeight: 9},
+	}
+
+	block := blockAt(2, 1000)
+	block.Reward = NewAmount(blockReward)
+	block.Validator = "validator"
+	_, _, events, err := executeBlock(block, nil)
+	if err != nil {
+		t.Fatalf("executeBlock() error = %v", err)
+	}
+
+	if len(events) != 1 || events[0].Type != "scheduled_transfer" || events[0].Attributes["id"] != "due" {
+		t.Errorf("block events = %v, want the due transfer", events)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("recipient balance = %s, want 10", balance)
+	}
+	if balance := getBalance("validator", NativeDenom); balance.Cmp(NewAmount(blockReward)) != 0 {
+		t.Errorf("validator balance = %s, want the reward", balance)
+	}
+}
+
+// testChain starts a chain whose genesis block is a minute old and funds a wallet
+func testChain(t *testing.T) (Block, *Wallet) {
+	t.Helper()
+	resetState()
+
+	genesis := blockAt(0, time.Now().Unix()-60)
+	genesis.Hash = calculateHash(genesis)
+	Blockchain = []Block{genesis}
+	receiptIndex = make(map[string]Receipt)
+
+	alice := NewWallet()
+	addBalance(publicKeyToString(alice.PublicKey), NativeDenom, NewAmount(100))
+	return genesis, alice
+}
+
+// rehash recomputes the receipts root and hash of a block a peer tampered with
+func rehash(block Block) Block {
+	block.ReceiptsRoot = calculateReceiptsRoot(block.Receipts)
+	block.Hash = calculateHash(block)
+	return block
+}
+
+func TestCreateVerifyAndCommitBlock(t *testing.T) {
+	genesis, alice := testChain(t)
+	from := publicKeyToString(alice.PublicKey)
+
+	tx := alice.CreateTransaction("bob", NewAmount(10))
+	tooLarge := alice.CreateTransaction("bob", NewAmount(1000))
+	tooLarge.Nonce = 1
+	tooLarge.Signature = alice.signTransaction(tooLarge)
+
+	block, err := createBlock(genesis, []Transaction{tx, tooLarge}, "validator")
+	if err != nil {
+		t.Fatalf("createBlock() error = %v", err)
+	}
+	if len(block.Transactions) != 1 || len(block.Receipts) != 1 || block.Receipts[0].Status != ReceiptSuccess {
+		t.Fatalf("block = %+v, want the valid transaction only", block)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("createBlock() changed the live state, bob balance = %s", balance)
+	}
+
+	verified, err := verifyBlock(block, genesis)
+	if err != nil {
+		t.Fatalf("verifyBlock() error = %v", err)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("verifyBlock() changed the live state, bob balance = %s", balance)
+	}
+
+	if err := commitBlock(verified); err != nil {
+		t.Fatalf("commitBlock() error = %v", err)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("bob balance = %s, want 10", balance)
+	}
+	if balance := getBalance(from, NativeDenom); balance.Cmp(NewAmount(90)) != 0 {
+		t.Errorf("alice balance = %s, want 90", balance)
+	}
+	if balance := getBalance("validator", NativeDenom); balance.Cmp(NewAmount(blockReward)) != 0 {
+		t.Errorf("validator balance = %s, want the reward", balance)
+	}
+	if accountNonces[from] != 1 {
+		t.Errorf("nonce = %d, want 1", accountNonces[from])
+	}
+	if _, err := GetReceipt(TransactionHash(tx)); err != nil {
+		t.Errorf("receipt was not indexed: %v", err)
+	}
+
+	// The parent is no longer the head, so the block cannot be verified or committed again
+	if _, err := verifyBlock(block, genesis); err == nil {
+		t.Error("verifyBlock() on a stale parent error = nil")
+	}
+	if err := commitBlock(verified); err == nil {
+		t.Error("second commitBlock() error = nil")
+	}
+	if err := commitBlock(block); err == nil {
+		t.Error("commitBlock() of an unverified block error = nil")
+	}
+}
+
+func TestVerifyBlockReExecutes(t *testing.T) {
+	genesis, alice := testChain(t)
+
+	tx := alice.CreateTransaction("bob", NewAmount(10))
+	block, err := createBlock(genesis, []Transaction{tx}, "validator")
+	if err != nil {
+		t.Fatalf("createBlock() error = %v", err)
+	}
+
+	// A receipt that does not match the execution, with a receipts root and hash to match it
+	forgedReceipt := block
+	forgedReceipt.Receipts = []Receipt{block.Receipts[0]}
+	forgedReceipt.Receipts[0].Status = ReceiptFailed
+	forgedReceipt = rehash(forgedReceipt)
+
+	// A replay of the transaction, which is invalid when it is executed
+	replay := block
+	replay.Transactions = []Transaction{tx, tx}
+	replay.Receipts = []Receipt{block.Receipts[0], block.Receipts[0]}
+	replay = rehash(replay)
+
+	// A transaction altered after it was signed
+	tampered := block
+	tampered.Transactions = []Transaction{tx}
+	tampered.Transactions[0].Amount = NewAmount(20)
+	tampered = rehash(tampered)
+
+	badHash := block
+	badHash.Hash = "0000"
+
+	tests := []struct {
+		name  string
+		block Block
+	}{
+		{"receipt status does not match the execution", forgedReceipt},
+		{"replayed transaction", replay},
+		{"invalid signature", tampered},
+		{"invalid hash", badHash},
+	}
+
+	for _, tt := range tests {
+		if _, err := verifyBlock(tt.block, genesis); err == nil {
+			t.Errorf("%s: verifyBlock() error = nil", tt.name)
+		}
+	}
+
+	// Block events are not part of the hash, so the ones a peer sends are replaced
+	forgedEvents := block
+	forgedEvents.Events = []Event{{Type: "scheduled_transfer", Attributes: map[string]string{"to": "mallory"}}}
+	verified, err := verifyBlock(forgedEvents, genesis)
+	if err != nil {
+		t.Fatalf("verifyBlock() error = %v", err)
+	}
+	if len(verified.Events) != 0 {
+		t.Errorf("block events = %v, want the events of the execution", verified.Events)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("failed verifications changed the live state, bob balance = %s", balance)
+	}
+}
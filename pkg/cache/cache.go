@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/perlin-network/life/compiler"
+	"github.com/perlin-network/life/exec"
+	"github.com/perlin-network/life/platform"
+)
+
+// A compiledContract is an instantiated module kept for later calls of the same code.
+// Instantiating parses, validates and compiles the module, so reusing it saves that
+// work on every call. The module is reset to its initial memory and globals before
+// each call, so a call never sees what an earlier one left behind.
+type compiledContract struct {
+	key     string // contractCacheKey of the module
+	hash    string
+	vm      *exec.VirtualMachine
+	host    *contractHost
+	memory  []byte  // Linear memory right after instantiation
+	globals []int64 // Globals right after instantiation
+	inUse   bool    // Set while a call runs, a reentrant call instantiates its own copy
+}
+
+// A persistedContract is a compiled module as stored in the data directory. Loading it
+// only parses the structure of the module again, the compiled code and the state right
+// after instantiation are read back.
+type persistedContract struct {
+	FunctionCode []compiler.InterpreterCode
+	Table        []uint32
+	Globals      []int64
+	Memory       []byte
+}
+
+// A contractCacheEntry is the file a compiled module is stored in. Its digest covers the
+// code hash and the encoded module, so a module that does not belong to the code or was
+// damaged on disk is compiled again instead of run.
+type contractCacheEntry struct {
+	Hash   string
+	Digest string
+	Module []byte // Encoded persistedContract
+}
+
+// The cache of compiled contracts is bounded by contractCacheSize and evicts the least
+// recently used module first. The compiled modules are persisted in the data directory
+// by a background writer, so a restarted node loads its hot contracts without compiling
+// them and block execution never waits for the disk. life loads AOT compiled code from
+// a temporary library, so native code is compiled again when contractAOT is set.
+var (
+	contractCache      = make(map[string]*list.Element)
+	contractCacheOrder = list.New() // Most recently used at the front
+	contractCacheMutex = &sync.Mutex{}
+	contractCacheOnce  sync.Once
+	contractCacheJobs  = make(chan func() error, 64)
+	contractCacheErr   error // Last error of the disk work, read through ContractCacheError
+)
+
+const (
+	contractCacheFile = "contract-cache.json"
+	contractCacheDir  = "contracts"
+)
+
+// contractCacheKey identifies a module by its code and the limits it was instantiated
+// with. The limits are part of the key, so after governance changes them a cached module
+// is never run under the old ones and every node runs the contract the same way.
+func contractCacheKey(hash string, config exec.VMConfig) string {
+	return fmt.Sprintf("%s-%d-%d-%d", hash, config.MaxMemoryPages, config.MaxCallStackDepth, config.MaxValueSlots)
+}
+
+// acquireContract returns a compiled module for the code that no other call is using
+func acquireContract(code []byte) (*compiledContract, error) {
+	contractCacheOnce.Do(startContractCache)
+
+	hash := codeHash(code)
+	key := contractCacheKey(hash, contractVMConfig())
+
+	contractCacheMutex.Lock()
+	if element, ok := contractCache[key]; ok {
+		contractCacheOrder.MoveToFront(element)
+		compiled := element.Value.(*compiledContract)
+		if !compiled.inUse {
+			compiled.inUse = true
+			contractCacheMutex.Unlock()
+			return compiled, nil
+		}
+	}
+	contractCacheMutex.Unlock()
+
+	compiled, err := compileContract(hash, code)
+	if err != nil {
+		return nil, err
+	}
+	compiled.inUse = true
+
+	contractCacheMutex.Lock()
+	defer contractCacheMutex.Unlock()
+
+	if _, ok := contractCache[key]; !ok {
+		contractCache[key] = contractCacheOrder.PushFront(compiled)
+		persisted := compiled.persisted()
+		queueContractCacheJob(func() error { return saveContract(key, hash, persisted) })
+		evictContracts()
+		queueContractCacheJob(saveContractCache(contractCacheKeys()))
+	}
+
+	return compiled, nil
+}
+
+func releaseContract(compiled *compiledContract) {
+	contractCacheMutex.Lock()
+	defer contractCacheMutex.Unlock()
+
+	compiled.inUse = false
+}
+
+func compileContract(hash string, code []byte) (*compiledContract, error) {
+	host := &contractHost{}
+	vm, err := newContractVM(host, code)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompiledContract(hash, vm, host)
+}
+
+func newCompiledContract(hash string, vm *exec.VirtualMachine, host *contractHost) (*compiledContract, error) {
+	// Run the contract as native code when the node is set up for it
+	if GlobalConfig["contractAOT"] != 0 {
+		aot, err := platform.FullAOTCompile(vm)
+		if err != nil {
+			return nil, fmt.Errorf("AOT compilation of contract %s failed: %v", hash, err)
+		}
+		vm.SetAOTService(aot)
+	}
+
+	return &compiledContract{
+		key:     contractCacheKey(hash, vm.Config),
+		hash:    hash,
+		vm:      vm,
+		host:    host,
+		memory:  append([]byte(nil), vm.Memory...),
+		globals: append([]int64(nil), vm.Globals...),
+	}, nil
+}
+
+// loadContract instantiates a module from its persisted compiled code
+func loadContract(key string, hash string, code []byte) (compiled *compiledContract, err error) {
+	// Imports are resolved here, unknown ones panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not load contract %s: %v", hash, r)
+		}
+	}()
+
+	encoded, err := ioutil.ReadFile(contractCachePath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry contractCacheEntry
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Hash != hash || entry.Digest != contractCacheDigest(hash, entry.Module) {
+		return nil, fmt.Errorf("cached module of contract %s does not match its code", hash)
+	}
+
+	var persisted persistedContract
+	err = gob.NewDecoder(bytes.NewReader(entry.Module)).Decode(&persisted)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := compiler.LoadModule(code)
+	if err != nil {
+		return nil, err
+	}
+	module.DisableFloatingPoint = true
+
+	host := &contractHost{}
+	var imports []exec.FunctionImportInfo
+	if module.Base.Import != nil {
+		for _, entry := range module.Base.Import.Entries {
+			if entry.Type.Kind() == wasm.ExternalFunction {
+				imports = append(imports, exec.FunctionImportInfo{
+					ModuleName: entry.ModuleName,
+					FieldName:  entry.FieldName,
+					F:          host.ResolveFunc(entry.ModuleName, entry.FieldName),
+				})
+			}
+		}
+	}
+
+	vm := &exec.VirtualMachine{
+		Module:          module,
+		Config:          contractVMConfig(),
+		FunctionCode:    persisted.FunctionCode,
+		FunctionImports: imports,
+		CallStack:       make([]exec.Frame, exec.DefaultCallStackSize),
+		CurrentFrame:    -1,
+		Table:           persisted.Table,
+		Globals:         persisted.Globals,
+		Memory:          persisted.Memory,
+		Exited:          true,
+		GasPolicy:       contractGasPolicy(),
+		ImportResolver:  host,
+	}
+
+	return newCompiledContract(hash, vm, host)
+}
+
+// contractCacheDigest ties an encoded module to the hash of the code it was compiled from
+func contractCacheDigest(hash string, module []byte) string {
+	hashed := sha256.Sum256(append([]byte(hash+"/"), module...))
+	return hex.EncodeToString(hashed[:])
+}
+
+// persisted returns the form of the module stored in the data directory
+func (c *compiledContract) persisted() persistedContract {
+	return persistedContract{
+		FunctionCode: c.vm.FunctionCode,
+		Table:        append([]uint32(nil), c.vm.Table...),
+		Globals:      c.globals,
+		Memory:       c.memory,
+	}
+}
+
+// bind resets the module and routes its host calls to env
+func (c *compiledContract) bind(env *contractEnv) *exec.VirtualMachine {
+	c.host.env = env
+
+	c.vm.Memory = append(c.vm.Memory[:0], c.memory...)
+	copy(c.vm.Globals, c.globals)
+	c.vm.Gas = 0
+	c.vm.GasLimitExceeded = false
+	c.vm.Exited = false
+	c.vm.ExitError = nil
+	c.vm.Config.GasLimit = uint64(env.gasLimit)
+
+	return c.vm
+}
+
+func evictContracts() {
+	for contractCacheOrder.Len() > GlobalConfig["contractCacheSize"] {
+		element := contractCacheOrder.Back()
+		compiled := element.Value.(*compiledContract)
+		contractCacheOrder.Remove(element)
+		delete(contractCache, compiled.key)
+
+		key := compiled.key
+		queueContractCacheJob(func() error { return os.Remove(contractCachePath(key)) })
+	}
+}
+
+// contractCacheKeys returns the keys of the cached modules, most recently used first
+func contractCacheKeys() []string {
+	var keys []string
+	for element := contractCacheOrder.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*compiledContract).key)
+	}
+	return keys
+}
+
+func contractCachePath(key string) string {
+	return filepath.Join(DataDir, contractCacheDir, key+".gob")
+}
+
+// queueContractCacheJob hands disk work to the background writer. The cache only
+// speeds up execution, so a job is dropped rather than waited for when the writer
+// falls behind.
+func queueContractCacheJob(job func() error) {
+	select {
+	case contractCacheJobs <- job:
+	default:
+	}
+}
+
+// ContractCacheError returns the last error the contract cache hit while loading or
+// persisting modules, for the node to report. Such errors never fail a contract call,
+// the module is compiled again instead.
+func ContractCacheError() error {
+	contractCacheMutex.Lock()
+	defer contractCacheMutex.Unlock()
+
+	return contractCacheErr
+}
+
+func setContractCacheError(err error) {
+	contractCacheMutex.Lock()
+	defer contractCacheMutex.Unlock()
+
+	contractCacheErr = err
+}
+
+// startContractCache loads the modules persisted when the node last ran and starts the writer
+func startContractCache() {
+	err := warmContractCache()
+	if err != nil {
+		setContractCacheError(err)
+	}
+
+	go func() {
+		for job := range contractCacheJobs {
+			err := job()
+			if err != nil {
+				setContractCacheError(err)
+			}
+		}
+	}()
+}
+
+func saveContract(key string, hash string, persisted persistedContract) error {
+	var module bytes.Buffer
+	err := gob.NewEncoder(&module).Encode(persisted)
+	if err != nil {
+		return err
+	}
+
+	entry := contractCacheEntry{
+		Hash:   hash,
+		Digest: contractCacheDigest(hash, module.Bytes()),
+		Module: module.Bytes(),
+	}
+
+	var encoded bytes.Buffer
+	err = gob.NewEncoder(&encoded).Encode(entry)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Join(DataDir, contractCacheDir), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(contractCachePath(key), encoded.Bytes(), 0644)
+}
+
+// saveContractCache returns a job persisting the order of the cached modules
+func saveContractCache(keys []string) func() error {
+	return func() error {
+		encoded, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(DataDir, 0755)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(DataDir, contractCacheFile), encoded, 0644)
+	}
+}
+
+// warmContractCache loads the contracts that were cached when the node last ran. Modules
+// persisted under other limits than the current ones are skipped, and so are modules that
+// fail to load, which are compiled again when they are called. The first load error is
+// returned once the others are loaded.
+func warmContractCache() error {
+	encoded, err := ioutil.ReadFile(filepath.Join(DataDir, contractCacheFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	err = json.Unmarshal(encoded, &keys)
+	if err != nil {
+		return err
+	}
+
+	contractCacheMutex.Lock()
+	defer contractCacheMutex.Unlock()
+
+	config := contractVMConfig()
+
+	// Add the least recently used first so the order is kept
+	var loadErr error
+	for i := len(keys) - 1; i >= 0; i-- {
+		hash := strings.SplitN(keys[i], "-", 2)[0]
+		code, ok := contractCode[hash]
+		if !ok || contractCacheKey(hash, config) != keys[i] {
+			continue
+		}
+
+		compiled, err := loadContract(keys[i], hash, code)
+		if err != nil {
+			if loadErr == nil {
+				loadErr = err
+			}
+			continue
+		}
+		contractCache[keys[i]] = contractCacheOrder.PushFront(compiled)
+	}
+	evictContracts()
+
+	return loadErr
+}
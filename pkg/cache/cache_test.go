@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestContractCacheKey(t *testing.T) {
+	config := contractVMConfig()
+	key := contractCacheKey("hash", config)
+
+	config.MaxMemoryPages++
+	if contractCacheKey("hash", config) == key {
+		t.Error("key does not change with the memory limit")
+	}
+	if contractCacheKey("other", contractVMConfig()) == key {
+		t.Error("key does not change with the code")
+	}
+}
+
+func TestAcquireContractReusesModule(t *testing.T) {
+	code := hostABIContract().code()
+
+	first, err := acquireContract(code)
+	if err != nil {
+		t.Fatalf("acquireContract() error = %v", err)
+	}
+
+	// A reentrant call gets a module of its own
+	second, err := acquireContract(code)
+	if err != nil {
+		t.Fatalf("acquireContract() error = %v", err)
+	}
+	if second == first {
+		t.Error("module in use was handed out twice")
+	}
+
+	releaseContract(first)
+	releaseContract(second)
+
+	third, err := acquireContract(code)
+	if err != nil {
+		t.Fatalf("acquireContract() error = %v", err)
+	}
+	defer releaseContract(third)
+	if third != first {
+		t.Error("released module was compiled again instead of reused")
+	}
+}
+
+func TestLoadContractChecksDigest(t *testing.T) {
+	code := hostABIContract().code()
+	hash := codeHash(code)
+	key := contractCacheKey(hash, contractVMConfig())
+
+	compiled, err := compileContract(hash, code)
+	if err != nil {
+		t.Fatalf("compileContract() error = %v", err)
+	}
+	if err := saveContract(key, hash, compiled.persisted()); err != nil {
+		t.Fatalf("saveContract() error = %v", err)
+	}
+
+	loaded, err := loadContract(key, hash, code)
+	if err != nil {
+		t.Fatalf("loadContract() error = %v", err)
+	}
+	if loaded.key != key || !bytes.Equal(loaded.memory, compiled.memory) {
+		t.Error("loaded module differs from the compiled one")
+	}
+
+	// The module belongs to other code
+	other := validCacheCode()
+	if _, err := loadContract(key, codeHash(other), other); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("loadContract() of other code error = %v", err)
+	}
+
+	// The module was damaged on disk
+	encoded, err := ioutil.ReadFile(contractCachePath(key))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var entry contractCacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&entry); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	entry.Module[len(entry.Module)-1] ^= 0xff
+
+	var damaged bytes.Buffer
+	if err := gob.NewEncoder(&damaged).Encode(entry); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if err := ioutil.WriteFile(contractCachePath(key), damaged.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := loadContract(key, hash, code); err == nil {
+		t.Error("loadContract() of a damaged module error = nil")
+	}
+}
+
+// validCacheCode is a module other than the host ABI test contract
+func validCacheCode() []byte {
+	return wasmModule{funcs: []wasmFunc{{name: "main", body: i32Const(1)}}}.code()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A ContractInstance is a deployed contract. Its code is stored once under its
+// content hash and shared by every instance, while each instance has its own
+// address, balance and storage namespace.
+type ContractInstance struct {
+	Address   string
+	CodeHash  string
+	Creator   string
+	Admin     string // Account that can migrate the contract, empty if it can never change
+	Height    int    // Block height the contract was deployed at
+	Reentrant bool   // Whether the contract can be called again while it is already running
+}
+
+// Admin of contracts that only a passed governance proposal can migrate
+const GovernanceAddress = "governance"
+
+// Maps code hashes to the code of deployed contracts
+var contractCode = make(map[string][]byte)
+
+// Maps contract addresses to their instances
+var contracts = make(map[string]ContractInstance)
+
+func GetContract(address string) (ContractInstance, error) {
+	instance, ok := contracts[address]
+	if !ok {
+		return ContractInstance{}, fmt.Errorf("contract not found: %s", address)
+	}
+	return instance, nil
+}
+
+func codeHash(code []byte) string {
+	hashed := sha256.Sum256(code)
+	return hex.EncodeToString(hashed[:])
+}
+
+// deployedAddress derives the address of a new instance from its creator, its code and the
+// operationID of the deploy message
+func deployedAddress(creator string, hash string, id string) string {
+	hashed := sha256.Sum256([]byte(creator + hash + id))
+	return contractPrefix + hex.EncodeToString(hashed[:])
+}
+
+// DeployContractTransaction stores the code of Contract.Code, or reuses the code stored
+// under the "codeHash" data key, and instantiates a contract running it. The amount of
+// the transaction funds the contract and Contract.Function names an optional constructor.
+// Contracts guard against reentrant calls unless the "reentrant" data key is set, and
+// can be migrated by the account in the "admin" data key.
+func DeployContractTransaction(tx Transaction) error {
+	if tx.Contract == nil {
+		return errors.New("missing smart contract")
+	}
+
+	hash, err := storeContractCode(tx)
+	if err != nil {
+		return err
+	}
+
+	reentrant, _ := tx.Data["reentrant"].(bool)
+	admin, _ := tx.Data["admin"].(string)
+
+	instance := ContractInstance{
+		Address:   deployedAddress(tx.From, hash, executionID(tx)),
+		CodeHash:  hash,
+		Creator:   tx.From,
+		Admin:     admin,
+		Height:    tx.blockHeight,
+		Reentrant: reentrant,
+	}
+	if _, ok := contracts[instance.Address]; ok {
+		return fmt.Errorf("contract already exists: %s", instance.Address)
+	}
+	journal.recordContract(instance.Address)
+	contracts[instance.Address] = instance
+
+	err = fundContract(tx, instance.Address)
+	if err != nil {
+		return err
+	}
+
+	emitEvent(tx, "contract_deploy", map[string]string{
+		"contract": instance.Address,
+		"codeHash": instance.CodeHash,
+		"creator":  instance.Creator,
+	})
+
+	if tx.Contract.Function == "" {
+		return nil
+	}
+
+	_, err = callContract(tx, instance, remainingGas(tx))
+	return err
+}
+
+// storeContractCode validates and stores the code of Contract.Code, or finds the code
+// stored under the "codeHash" data key, and returns its hash
+func storeContractCode(tx Transaction) (string, error) {
+	hash, _ := tx.Data["codeHash"].(string)
+	code := tx.Contract.Code
+	if len(code) > 0 {
+		hash = codeHash(code)
+	} else if code = contractCode[hash]; code == nil {
+		return "", fmt.Errorf("contract code not found: %s", hash)
+	}
+
+	// Stored code is checked again, the entry points it must export depend on the transaction
+	err := validateContractCode(code, tx.Contract.Function)
+	if err != nil {
+		return "", err
+	}
+	journal.recordContractCode(hash)
+	contractCode[hash] = code
+
+	return hash, nil
+}
+
+// MigrateContractTransaction switches the contract at Contract.Address to new code, given
+// like for a deploy. Its storage and balance are kept and Contract.Function names an
+// optional migration function run with the new code. Only the admin can migrate a contract.
+func MigrateContractTransaction(tx Transaction) error {
+	if tx.Contract == nil {
+		return errors.New("missing smart contract")
+	}
+
+	instance, err := adminContract(tx, tx.Contract.Address)
+	if err != nil {
+		return err
+	}
+
+	hash, err := storeContractCode(tx)
+	if err != nil {
+		return err
+	}
+
+	previous := instance.CodeHash
+	instance.CodeHash = hash
+	journal.recordContract(instance.Address)
+	contracts[instance.Address] = instance
+
+	emitEvent(tx, "contract_migrate", map[string]string{
+		"contract": instance.Address,
+		"from":     previous,
+		"to":       hash,
+	})
+
+	if tx.Contract.Function == "" {
+		return nil
+	}
+
+	_, err = callContract(tx, instance, remainingGas(tx))
+	return err
+}
+
+func UpdateContractAdminTransaction(tx Transaction) error {
+	if tx.To == "" {
+		return errors.New("invalid admin")
+	}
+
+	address, _ := tx.Data["contract"].(string)
+	instance, err := adminContract(tx, address)
+	if err != nil {
+		return err
+	}
+
+	instance.Admin = tx.To
+	journal.recordContract(address)
+	contracts[address] = instance
+
+	emitEvent(tx, "contract_update_admin", map[string]string{"contract": address, "admin": tx.To})
+
+	return nil
+}
+
+// ClearContractAdminTransaction removes the admin, the contract can never be migrated again
+func ClearContractAdminTransaction(tx Transaction) error {
+	address, _ := tx.Data["contract"].(string)
+	instance, err := adminContract(tx, address)
+	if err != nil {
+		return err
+	}
+
+	instance.Admin = ""
+	journal.recordContract(address)
+	contracts[address] = instance
+
+	emitEvent(tx, "contract_clear_admin", map[string]string{"contract": address})
+
+	return nil
+}
+
+// adminContract returns a contract the sender of the transaction administers
+func adminContract(tx Transaction, address string) (ContractInstance, error) {
+	instance, err := GetContract(address)
+	if err != nil {
+		return instance, err
+	}
+
+	if instance.Admin == "" {
+		return instance, errors.New("contract has no admin")
+	}
+
+	if tx.From != instance.Admin {
+		return instance, errors.New("only the contract admin can change the contract")
+	}
+
+	return instance, nil
+}
+
+// ContractTransaction calls Contract.Function on the contract at Contract.Address.
+// The amount of the transaction is sent to the contract before the call.
+func ContractTransaction(tx Transaction) error {
+	if tx.Contract == nil {
+		return errors.New("missing smart contract")
+	}
+
+	instance, err := GetContract(tx.Contract.Address)
+	if err != nil {
+		return err
+	}
+
+	err = fundContract(tx, instance.Address)
+	if err != nil {
+		return err
+	}
+
+	_, err = callContract(tx, instance, remainingGas(tx))
+	if err != nil {
+		return err
+	}
+
+	emitEvent(tx, "contract_call", map[string]string{
+		"contract": instance.Address,
+		"function": contractFunction(tx.Contract),
+		"caller":   tx.From,
+	})
+
+	return nil
+}
+
+// executeContractMessage runs a contract call carried by an IBC packet or a governance
+// proposal through the same path as a contract transaction, so its effects are applied
+// once and rolled back if it fails. Code shipped without an address runs as the
+// instance derived from the code. It runs at the height and time of the block that
+// carries the packet or passes the proposal.
+func executeContractMessage(sender string, sc SmartContract, height int, now int64) error {
+	return journaled(false, func() error {
+		if sc.Address == "" {
+			sc.Address = contractAddress(sc.Code)
+			if _, ok := contracts[sc.Address]; !ok {
+				err := validateContractCode(sc.Code, "")
+				if err != nil {
+					return err
+				}
+
+				hash := codeHash(sc.Code)
+				journal.recordContractCode(hash)
+				contractCode[hash] = sc.Code
+				journal.recordContract(sc.Address)
+				contracts[sc.Address] = ContractInstance{
+					Address:  sc.Address,
+					CodeHash: hash,
+					Creator:  sender,
+					Height:   height,
+				}
+			}
+			sc.Code = nil
+		}
+
+		tx := Transaction{
+			Type:        "contract",
+			From:        sender,
+			Contract:    &sc,
+			GasLimit:    GlobalConfig["maxGasLimit"],
+			blockHeight: height,
+			blockTime:   now,
+		}
+
+		return ContractTransaction(tx)
+	})
+}
+
+// callContract runs the function a transaction calls on a contract instance
+func callContract(tx Transaction, instance ContractInstance, gasLimit int) (int64, error) {
+	input, err := json.Marshal(tx.Contract.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	env := newContractEnv(tx, tx.From, instance.Address, gasLimit)
+	env.input = input
+
+	return runContract(env, contractCode[instance.CodeHash], contractFunction(tx.Contract), tx.Contract.Args...)
+}
+
+func contractFunction(sc *SmartContract) string {
+	if sc.Function == "" {
+		return "main"
+	}
+	return sc.Function
+}
+
+// fundContract sends the amount of a transaction to a contract
+func fundContract(tx Transaction, address string) error {
+	if tx.Amount.IsZero() {
+		return nil
+	}
+
+	err := spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	return addBalance(address, tx.Denom, tx.Amount)
+}
+
+// DeployContract creates a transaction deploying code, calling the constructor if one is named
+func (w *Wallet) DeployContract(code []byte, constructor string, args []int64, gasLimit int, gasPrice Amount) Transaction {
+	tx := Transaction{
+		Type:         "contract_deploy",
+		From:         publicKeyToString(w.PublicKey),
+		Contract:     &SmartContract{Code: code, Function: constructor, Args: args},
+		GasLimit:     gasLimit,
+		GasPrice:     gasPrice,
+		ExpiryHeight: defaultExpiryHeight(),
+	}
+
+	tx.Signature = w.signTransaction(tx)
+
+	return tx
+}
+
+// CallContract creates a transaction calling a function of a deployed contract
+func (w *Wallet) CallContract(address string, function string, args []int64, data map[string]interface{}, amount Amount, gasLimit int, gasPrice Amount) Transaction {
+	tx := Transaction{
+		Type:         "contract",
+		From:         publicKeyToString(w.PublicKey),
+		Amount:       amount,
+		Contract:     &SmartContract{Address: address, Function: function, Args: args, Data: data},
+		GasLimit:     gasLimit,
+		GasPrice:     gasPrice,
+		ExpiryHeight: defaultExpiryHeight(),
+	}
+
+	tx.Signature = w.signTransaction(tx)
+
+	return tx
+}
@@ -0,0 +1,123 @@
+package main
+
+import "testing"
+
+// constructorContract stores an entry from ok, and aborts after storing it from fail
+func constructorContract() wasmModule {
+	const (
+		storageSet = iota
+		abort
+	)
+
+	return wasmModule{
+		imports: []wasmFunc{
+			{name: "storage_set", params: 4},
+			{name: "abort", params: 2},
+		},
+		funcs: []wasmFunc{
+			{name: "ok", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, i32Const(0))},
+			{name: "fail", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, wasmCall(abort, 2, 4))},
+		},
+		data: "bxfail",
+	}
+}
+
+func deployTx(txHash string, contract SmartContract, data map[string]interface{}) Transaction {
+	return Transaction{
+		Type:        "contract_deploy",
+		From:        "alice",
+		Amount:      NewAmount(10),
+		Contract:    &contract,
+		Data:        data,
+		GasLimit:    100000,
+		receipt:     &Receipt{TxHash: txHash},
+		blockHeight: 5,
+	}
+}
+
+func TestDeployContractTransaction(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	code := constructorContract().code()
+	hash := codeHash(code)
+
+	if err := applyTransaction(deployTx("deploy", SmartContract{Code: code, Function: "ok"}, nil)); err != nil {
+		t.Fatalf("deploy error = %v", err)
+	}
+	address := deployedAddress("alice", hash, operationID("deploy", 0))
+	instance, err := GetContract(address)
+	if err != nil || instance.CodeHash != hash || instance.Creator != "alice" || instance.Height != 5 {
+		t.Fatalf("contract = %+v, %v", instance, err)
+	}
+
+	// The constructor ran and paid the deposit of its entry out of the funds it was sent
+	if _, err := ContractStorage(address, "b"); err != nil {
+		t.Errorf("constructor storage: %v", err)
+	}
+	if balance := getBalance(address, NativeDenom); balance.Cmp(NewAmount(8)) != 0 {
+		t.Errorf("contract balance = %s, want 8", balance)
+	}
+
+	// Code is stored once and can be instantiated again by its hash
+	if err := applyTransaction(deployTx("again", SmartContract{}, map[string]interface{}{"codeHash": hash})); err != nil {
+		t.Fatalf("deploy by code hash error = %v", err)
+	}
+	second := deployedAddress("alice", hash, operationID("again", 0))
+	if second == address {
+		t.Fatal("second instance got the address of the first")
+	}
+	if instance, err := GetContract(second); err != nil || instance.CodeHash != hash {
+		t.Errorf("second contract = %+v, %v", instance, err)
+	}
+	if len(contractCode) != 1 {
+		t.Errorf("%d code entries, want the code stored once", len(contractCode))
+	}
+
+	if err := applyTransaction(deployTx("missing", SmartContract{}, map[string]interface{}{"codeHash": "unknown"})); err == nil {
+		t.Error("deploy of unknown code hash error = nil")
+	}
+}
+
+func TestFailedConstructorRollsBackDeploy(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	err := applyTransaction(deployTx("deploy", SmartContract{Code: constructorContract().code(), Function: "fail"}, nil))
+	if err == nil {
+		t.Fatal("deploy with a failing constructor error = nil")
+	}
+
+	if len(contracts) != 0 || len(contractCode) != 0 || len(contractStorage) != 0 {
+		t.Errorf("deploy left contracts %v, code of %d contracts and storage %v", contracts, len(contractCode), contractStorage)
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("creator balance = %s, want 100", balance)
+	}
+}
+
+func TestContractTransaction(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	deployTestContract("contract:b", constructorContract())
+
+	tx := Transaction{Type: "contract", From: "alice", Amount: NewAmount(10), Contract: &SmartContract{Address: "contract:b", Function: "ok"}, GasLimit: 100000, receipt: &Receipt{}}
+	if err := applyTransaction(tx); err != nil {
+		t.Fatalf("ContractTransaction() error = %v", err)
+	}
+	if events := tx.receipt.Events; len(events) != 1 || events[0].Type != "contract_call" || events[0].Attributes["function"] != "ok" {
+		t.Errorf("events = %v, want the contract call", events)
+	}
+
+	tx.Contract = &SmartContract{Address: "contract:b", Function: "fail"}
+	if err := applyTransaction(tx); err == nil {
+		t.Error("failing call error = nil")
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(90)) != 0 {
+		t.Errorf("caller balance = %s, want only the first call funded", balance)
+	}
+
+	tx.Contract = &SmartContract{Address: "contract:missing"}
+	if err := applyTransaction(tx); err == nil {
+		t.Error("call of a missing contract error = nil")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const NativeDenom = "kiwi"
+
+const ibcVoucherPrefix = "ibc/"
+
+// Balances are held per account and denomination
+type balanceKey struct {
+	Account string
+	Denom   string
+}
+
+type DenomMetadata struct {
+	Denom       string
+	Symbol      string
+	Decimals    int
+	Description string
+	Issuer      string // Account that registered the denomination
+}
+
+// Registered denominations, amounts in any other denomination are rejected
+var denoms = map[string]DenomMetadata{
+	NativeDenom: {Denom: NativeDenom, Symbol: "KIWI", Decimals: 0, Description: "Native coin of the Kiwi chain"},
+}
+
+// denomOrNative returns the denomination to use when none is specified
+func denomOrNative(denom string) string {
+	if denom == "" {
+		return NativeDenom
+	}
+	return denom
+}
+
+func isKnownDenom(denom string) bool {
+	_, ok := denoms[denomOrNative(denom)]
+	return ok
+}
+
+// hasKnownDenoms checks that every amount and the fee of a transaction use registered denominations
+func hasKnownDenoms(tx Transaction) bool {
+	if !isKnownDenom(tx.Denom) || !isKnownDenom(tx.FeeDenom) {
+		return false
+	}
+
+	for _, msg := range tx.Messages {
+		if !isKnownDenom(msg.Denom) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetDenomMetadata(denom string) (DenomMetadata, error) {
+	metadata, ok := denoms[denomOrNative(denom)]
+	if !ok {
+		return DenomMetadata{}, fmt.Errorf("unknown denomination: %s", denom)
+	}
+	return metadata, nil
+}
+
+// RegisterDenomTransaction registers a denomination with its metadata. Registration burns the
+// denomRegistrationFee in the native coin, so squatting names and metadata has a price.
+// Registrations made by governance are free.
+func RegisterDenomTransaction(tx Transaction) error {
+	denom, ok := tx.Data["denom"].(string)
+	if !ok || denom == "" {
+		return errors.New("invalid denomination")
+	}
+
+	// Token factory and IBC voucher denominations are derived, never registered directly
+	if strings.HasPrefix(denom, tokenPrefix) || strings.HasPrefix(denom, ibcVoucherPrefix) {
+		return fmt.Errorf("reserved denomination prefix: %s", denom)
+	}
+
+	if _, ok := denoms[denom]; ok {
+		return fmt.Errorf("denomination already registered: %s", denom)
+	}
+
+	symbol, ok := tx.Data["symbol"].(string)
+	if !ok || symbol == "" {
+		return errors.New("invalid symbol")
+	}
+
+	decimals, _ := dataInt(tx.Data, "decimals")
+	if decimals < 0 || decimals > 18 {
+		return errors.New("invalid decimals")
+	}
+
+	description, _ := tx.Data["description"].(string)
+
+	if tx.From != GovernanceAddress {
+		fee := NewAmount(int64(GlobalConfig["denomRegistrationFee"]))
+		err := spendBalance(tx.From, NativeDenom, fee, tx.blockTime)
+		if err != nil {
+			return errors.New("insufficient balance to pay the denomination registration fee")
+		}
+	}
+
+	journal.recordDenom(denom)
+	denoms[denom] = DenomMetadata{
+		Denom:       denom,
+		Symbol:      symbol,
+		Decimals:    int(decimals),
+		Description: description,
+		Issuer:      tx.From,
+	}
+
+	emitEvent(tx, "denom_register", map[string]string{"denom": denom, "issuer": tx.From})
+
+	return nil
+}
+
+// ibcVoucherDenom names the denomination of tokens received over an IBC channel, so that
+// tokens with the same name on different chains or channels never mix
+func ibcVoucherDenom(port string, channel string, denom string) string {
+	hashed := sha256.Sum256([]byte(port + "/" + channel + "/" + denom))
+	return ibcVoucherPrefix + strings.ToUpper(hex.EncodeToString(hashed[:]))
+}
+
+// registerIBCVoucher registers the voucher denomination of tokens received over a channel
+// the first time they arrive and returns it
+func registerIBCVoucher(port string, channel string, denom string) string {
+	voucher := ibcVoucherDenom(port, channel, denom)
+	if _, ok := denoms[voucher]; !ok {
+		journal.recordDenom(voucher)
+		denoms[voucher] = DenomMetadata{
+			Denom:       voucher,
+			Symbol:      denom,
+			Description: fmt.Sprintf("%s received over %s/%s", denom, port, channel),
+		}
+	}
+	return voucher
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestRegisterDenom(t *testing.T) {
+	fee := int64(GlobalConfig["denomRegistrationFee"])
+
+	tests := []struct {
+		name    string
+		from    string
+		denom   string
+		balance int64
+		valid   bool
+	}{
+		{"pays the fee", "alice", "usd", fee + 5, true},
+		{"cannot pay the fee", "alice", "usd", fee - 1, false},
+		{"governance pays no fee", GovernanceAddress, "usd", 5, true},
+		{"native denomination", "alice", NativeDenom, fee, false},
+		{"token factory prefix", "alice", tokenPrefix + "x/usd", fee, false},
+		{"ibc voucher prefix", "alice", ibcVoucherDenom("transfer", "channel-0", "usd"), fee, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		addBalance(tt.from, NativeDenom, NewAmount(tt.balance))
+
+		tx := Transaction{From: tt.from, Data: map[string]interface{}{"denom": tt.denom, "symbol": "USD", "decimals": 6}}
+		err := RegisterDenomTransaction(tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: RegisterDenomTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		want := NewAmount(tt.balance)
+		if tt.valid && tt.from != GovernanceAddress {
+			want = NewAmount(tt.balance - fee)
+		}
+		if balance := getBalance(tt.from, NativeDenom); balance.Cmp(want) != 0 {
+			t.Errorf("%s: balance = %s, want %s", tt.name, balance, want)
+		}
+
+		if !tt.valid {
+			continue
+		}
+		metadata, err := GetDenomMetadata(tt.denom)
+		if err != nil || metadata.Symbol != "USD" || metadata.Decimals != 6 || metadata.Issuer != tt.from {
+			t.Errorf("%s: metadata = %+v, %v", tt.name, metadata, err)
+		}
+	}
+}
+
+func TestBalancesPerDenomination(t *testing.T) {
+	resetState()
+	denoms["usd"] = DenomMetadata{Denom: "usd"}
+	addBalance("alice", NativeDenom, NewAmount(10))
+	addBalance("alice", "usd", NewAmount(20))
+
+	if err := TransferTransaction(Transaction{From: "alice", To: "bob", Amount: NewAmount(15), Denom: "usd"}); err != nil {
+		t.Fatalf("TransferTransaction() error = %v", err)
+	}
+	if err := TransferTransaction(Transaction{From: "alice", To: "bob", Amount: NewAmount(11)}); err == nil {
+		t.Error("TransferTransaction() error = nil, the native balance does not cover it")
+	}
+
+	tests := []struct {
+		account string
+		denom   string
+		want    int64
+	}{
+		{"alice", NativeDenom, 10},
+		{"alice", "", 10},
+		{"alice", "usd", 5},
+		{"bob", "usd", 15},
+		{"bob", NativeDenom, 0},
+	}
+	for _, tt := range tests {
+		if balance := getBalance(tt.account, tt.denom); balance.Cmp(NewAmount(tt.want)) != 0 {
+			t.Errorf("%s %q balance = %s, want %d", tt.account, tt.denom, balance, tt.want)
+		}
+	}
+
+	if hasKnownDenoms(Transaction{From: "alice", Amount: NewAmount(1), Denom: "eur"}) {
+		t.Error("hasKnownDenoms() = true for an unregistered denomination")
+	}
+}
+
+func TestRegisterIBCVoucher(t *testing.T) {
+	resetState()
+
+	first := registerIBCVoucher("transfer", "channel-0", "atom")
+	again := registerIBCVoucher("transfer", "channel-0", "atom")
+	other := registerIBCVoucher("transfer", "channel-1", "atom")
+
+	if first != again {
+		t.Errorf("same channel and denomination gave %s and %s", first, again)
+	}
+	if first == other {
+		t.Errorf("different channels share the voucher %s", first)
+	}
+	if !isKnownDenom(first) || !isKnownDenom(other) {
+		t.Errorf("vouchers were not registered")
+	}
+}
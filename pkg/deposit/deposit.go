@@ -0,0 +1,94 @@
+package main
+
+import "errors"
+
+// Contracts pay a refundable deposit in the native coin for every byte they keep in
+// storage, taken from their own balance when an entry is written and returned when it
+// is deleted. The price per byte is the storageDepositPerByte parameter, which governance
+// can change. Each entry remembers the deposit paid for it, so a price change never
+// refunds more or less than was paid.
+//
+// Entries written before deposits were introduced have no deposit recorded. Deleting
+// one refunds nothing and overwriting one pays the full deposit of the new value.
+//
+// Maps contract addresses and storage keys to the deposit paid for the entry
+var storageDeposits = make(map[string]map[string]Amount)
+
+func storageDeposit(key string, value []byte) (Amount, error) {
+	price := NewAmount(int64(GlobalConfig["storageDepositPerByte"]))
+	return price.MulInt(int64(len(key) + len(value)))
+}
+
+// lockStorageDeposit settles the deposit of an entry for its new value. Only the difference
+// to the deposit already paid for the entry moves, and nothing changes if the contract
+// cannot pay it. A legacy entry, written before deposits were introduced, counts as paid
+// with a zero deposit, so overwriting it pays the full deposit of the new value.
+func lockStorageDeposit(address string, key string, value []byte) error {
+	deposit, err := storageDeposit(key, value)
+	if err != nil {
+		return err
+	}
+
+	paid := storageDeposits[address][key]
+	if paid.LT(deposit) {
+		owed, err := deposit.Sub(paid)
+		if err != nil {
+			return err
+		}
+		if getBalance(address, NativeDenom).LT(owed) {
+			return errors.New("insufficient contract balance for storage deposit")
+		}
+		err = subBalance(address, NativeDenom, owed)
+		if err != nil {
+			return err
+		}
+	} else {
+		refund, err := paid.Sub(deposit)
+		if err != nil {
+			return err
+		}
+		err = addBalance(address, NativeDenom, refund)
+		if err != nil {
+			return err
+		}
+	}
+
+	if storageDeposits[address] == nil {
+		storageDeposits[address] = make(map[string]Amount)
+	}
+	storageDeposits[address][key] = deposit
+
+	return nil
+}
+
+func refundStorageDeposit(address string, key string) error {
+	deposit, ok := storageDeposits[address][key]
+	if !ok {
+		return nil
+	}
+
+	err := addBalance(address, NativeDenom, deposit)
+	if err != nil {
+		return err
+	}
+
+	delete(storageDeposits[address], key)
+	if len(storageDeposits[address]) == 0 {
+		delete(storageDeposits, address)
+	}
+
+	return nil
+}
+
+// GetStorageDeposit returns the total deposit a contract has locked for its storage
+func GetStorageDeposit(address string) (Amount, error) {
+	var total Amount
+	for _, deposit := range storageDeposits[address] {
+		var err error
+		total, err = total.Add(deposit)
+		if err != nil {
+			return Amount{}, err
+		}
+	}
+	return total, nil
+}
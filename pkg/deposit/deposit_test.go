@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func TestLockStorageDeposit(t *testing.T) {
+	tests := []struct {
+		name    string
+		paid    int64 // Deposit recorded for the entry before the write, -1 for none
+		balance int64
+		value   string
+		valid   bool
+		after   int64 // Contract balance after the write
+	}{
+		// The deposit of key "k" and a value of n bytes is 1+n
+		{name: "new entry", paid: -1, balance: 10, value: "abcd", valid: true, after: 5},
+		{name: "larger value pays the difference", paid: 3, balance: 2, value: "abcd", valid: true, after: 0},
+		{name: "smaller value refunds the difference", paid: 5, balance: 0, value: "a", valid: true, after: 3},
+		{name: "same size moves nothing", paid: 5, balance: 0, value: "dcba", valid: true, after: 0},
+		{name: "difference not covered", paid: 3, balance: 1, value: "abcd", valid: false, after: 1},
+		{name: "legacy entry pays the full deposit", paid: -1, balance: 5, value: "abcd", valid: true, after: 0},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		addBalance("contract", NativeDenom, NewAmount(tt.balance))
+		if tt.paid >= 0 {
+			storageDeposits["contract"] = map[string]Amount{"k": NewAmount(tt.paid)}
+		}
+
+		err := lockStorageDeposit("contract", "k", []byte(tt.value))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: lockStorageDeposit() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+
+		if balance := getBalance("contract", NativeDenom); balance.Cmp(NewAmount(tt.after)) != 0 {
+			t.Errorf("%s: contract balance = %s, want %d", tt.name, balance, tt.after)
+		}
+
+		want := NewAmount(int64(1 + len(tt.value)))
+		if !tt.valid && tt.paid >= 0 {
+			want = NewAmount(tt.paid)
+		}
+		if deposit := storageDeposits["contract"]["k"]; deposit.Cmp(want) != 0 {
+			t.Errorf("%s: recorded deposit = %s, want %s", tt.name, deposit, want)
+		}
+	}
+}
+
+func TestRefundStorageDeposit(t *testing.T) {
+	resetState()
+	storageDeposits["contract"] = map[string]Amount{"k": NewAmount(5)}
+
+	tests := []struct {
+		name  string
+		key   string
+		after int64
+	}{
+		{"paid entry", "k", 5},
+		{"already refunded", "k", 5},
+		{"legacy entry refunds nothing", "legacy", 5},
+	}
+
+	for _, tt := range tests {
+		err := refundStorageDeposit("contract", tt.key)
+		if err != nil {
+			t.Errorf("%s: refundStorageDeposit() error = %v", tt.name, err)
+		}
+		if balance := getBalance("contract", NativeDenom); balance.Cmp(NewAmount(tt.after)) != 0 {
+			t.Errorf("%s: contract balance = %s, want %d", tt.name, balance, tt.after)
+		}
+	}
+
+	if len(storageDeposits) != 0 {
+		t.Errorf("deposits left after refund: %v", storageDeposits)
+	}
+}
+
+func TestContractStorageDeposit(t *testing.T) {
+	resetState()
+	deployTestContract("contract:abi", hostABIContract())
+	addBalance("contract:abi", NativeDenom, NewAmount(5))
+
+	// Key "key" and value "value" cost a deposit of 8
+	if ret, _, err := callTestContract(t, "contract:abi", "store", 100000); err != nil || int32(ret) != -1 {
+		t.Fatalf("store without the deposit = %d, %v, want the write refused", ret, err)
+	}
+	if _, err := ContractStorage("contract:abi", "key"); err == nil {
+		t.Error("entry was stored without its deposit")
+	}
+
+	addBalance("contract:abi", NativeDenom, NewAmount(5))
+	if ret, _, err := callTestContract(t, "contract:abi", "store", 100000); err != nil || ret != 5 {
+		t.Fatalf("store = %d, %v", ret, err)
+	}
+	if balance := getBalance("contract:abi", NativeDenom); balance.Cmp(NewAmount(2)) != 0 {
+		t.Errorf("contract balance = %s, want 2", balance)
+	}
+	if deposit, err := GetStorageDeposit("contract:abi"); err != nil || deposit.Cmp(NewAmount(8)) != 0 {
+		t.Errorf("GetStorageDeposit() = %s, %v, want 8", deposit, err)
+	}
+
+	// A price change does not change what is refunded
+	price := GlobalConfig["storageDepositPerByte"]
+	GlobalConfig["storageDepositPerByte"] = 3
+	defer func() { GlobalConfig["storageDepositPerByte"] = price }()
+
+	if _, _, err := callTestContract(t, "contract:abi", "delete", 100000); err != nil {
+		t.Fatalf("delete error = %v", err)
+	}
+	if balance := getBalance("contract:abi", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("contract balance = %s, want the deposit of 8 refunded", balance)
+	}
+	if deposit, err := GetStorageDeposit("contract:abi"); err != nil || !deposit.IsZero() {
+		t.Errorf("GetStorageDeposit() = %s, %v, want 0", deposit, err)
+	}
+}
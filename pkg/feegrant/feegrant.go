@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// A FeeAllowance lets the granter pay the fees of the grantee's transactions.
+// The grantee names the granter as FeePayer and no fee payer signature is needed.
+type FeeAllowance struct {
+	Granter         string
+	Grantee         string
+	SpendLimit      Amount   // Total fees the allowance pays for, zero for no limit
+	Denom           string   // Denomination of SpendLimit
+	Spent           Amount   // Fees paid so far
+	Expiration      int      // Last block height the allowance can be used in, 0 if it never expires
+	AllowedMessages []string // Transaction types the allowance pays for, empty for all
+}
+
+type feeAllowanceKey struct {
+	Granter string
+	Grantee string
+}
+
+var feeAllowances = make(map[feeAllowanceKey]FeeAllowance)
+
+// feePayerDomain tags the payload the fee payer signs, so that a signature made as
+// the sender can never be passed off as the fee payer's agreement or the other way round
+const feePayerDomain = "kiwi/fee-payer/"
+
+// feePayer returns the account that pays the fee of a transaction
+func feePayer(tx Transaction) string {
+	if tx.FeePayer != "" {
+		return tx.FeePayer
+	}
+	return tx.From
+}
+
+// usesFeeAllowance reports whether the fee is paid under a fee grant rather than co-signed by the payer
+func usesFeeAllowance(tx Transaction) bool {
+	return tx.FeePayer != "" && tx.FeePayer != tx.From && tx.FeePayerSignature == ""
+}
+
+func isValidFeePayer(tx Transaction) bool {
+	if tx.FeePayer == "" || tx.FeePayer == tx.From {
+		return true
+	}
+
+	// The allowance is checked against the state, no signature is needed
+	if usesFeeAllowance(tx) {
+		return true
+	}
+
+	pubKey := convertPublicKey(tx.FeePayer)
+	if pubKey == nil {
+		return false
+	}
+
+	hashed := feePayerHash(tx)
+	if hashed == nil {
+		return false
+	}
+
+	return verifySignature(pubKey, hashed, tx.FeePayerSignature)
+}
+
+// feePayerHash returns the digest the fee payer signs, the signed payload of the
+// transaction under the fee payer domain tag
+func feePayerHash(tx Transaction) []byte {
+	hashed := transactionHash(tx)
+	if hashed == nil {
+		return nil
+	}
+
+	tagged := sha256.Sum256(append([]byte(feePayerDomain), hashed...))
+	return tagged[:]
+}
+
+// hasFeeAllowance checks the allowance of a fee paid under a fee grant
+func hasFeeAllowance(tx Transaction) bool {
+	if !usesFeeAllowance(tx) {
+		return true
+	}
+
+	err := checkFeeAllowance(tx, tx.blockHeight)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+func checkFeeAllowance(tx Transaction, height int) error {
+	allowance, ok := feeAllowances[feeAllowanceKey{Granter: tx.FeePayer, Grantee: tx.From}]
+	if !ok {
+		return errors.New("no fee allowance from fee payer")
+	}
+
+	if allowance.Expiration != 0 && height > allowance.Expiration {
+		return errors.New("fee allowance has expired")
+	}
+
+	if !allowance.SpendLimit.IsZero() {
+		if denomOrNative(tx.FeeDenom) != allowance.Denom {
+			return fmt.Errorf("fee allowance only covers fees in %s", allowance.Denom)
+		}
+
+		fee, err := maxFee(tx)
+		if err != nil {
+			return err
+		}
+
+		spent, err := allowance.Spent.Add(fee)
+		if err != nil || allowance.SpendLimit.LT(spent) {
+			return errors.New("fee allowance spend limit exceeded")
+		}
+	}
+
+	if len(allowance.AllowedMessages) > 0 {
+		for _, txType := range transactionTypes(tx) {
+			if !containsString(allowance.AllowedMessages, txType) {
+				return fmt.Errorf("fee allowance does not cover %s transactions", txType)
+			}
+		}
+	}
+
+	return nil
+}
+
+func useFeeAllowance(tx Transaction, height int) error {
+	err := checkFeeAllowance(tx, height)
+	if err != nil {
+		return err
+	}
+
+	fee, err := maxFee(tx)
+	if err != nil {
+		return err
+	}
+
+	key := feeAllowanceKey{Granter: tx.FeePayer, Grantee: tx.From}
+	allowance := feeAllowances[key]
+	allowance.Spent, err = allowance.Spent.Add(fee)
+	if err != nil {
+		return err
+	}
+	journal.recordFeeAllowance(key)
+	feeAllowances[key] = allowance
+
+	return nil
+}
+
+// refundFeeAllowance gives back the part of a reserved fee that was refunded to the granter
+func refundFeeAllowance(tx Transaction, refund Amount) {
+	key := feeAllowanceKey{Granter: tx.FeePayer, Grantee: tx.From}
+	allowance, ok := feeAllowances[key]
+	if !ok {
+		return
+	}
+
+	spent, err := allowance.Spent.Sub(refund)
+	if err != nil {
+		spent = Amount{}
+	}
+	allowance.Spent = spent
+	journal.recordFeeAllowance(key)
+	feeAllowances[key] = allowance
+}
+
+func GrantFeeAllowanceTransaction(tx Transaction) error {
+	if tx.To == "" || tx.To == tx.From {
+		return errors.New("invalid grantee")
+	}
+
+	// An allowance is unlimited only when it sets no spend limit, a limit it sets must be valid
+	var spendLimit Amount
+	if _, ok := tx.Data["spendLimit"]; ok {
+		spendLimit, ok = dataAmount(tx.Data, "spendLimit")
+		if !ok || spendLimit.IsZero() {
+			return errors.New("invalid spend limit")
+		}
+	}
+
+	expiration, _ := dataInt(tx.Data, "expiration")
+	if expiration < 0 {
+		return errors.New("invalid fee allowance")
+	}
+
+	denom, _ := tx.Data["denom"].(string)
+	if !isKnownDenom(denom) {
+		return fmt.Errorf("unknown denomination: %s", denom)
+	}
+
+	// A new grant replaces the previous allowance between the two accounts
+	key := feeAllowanceKey{Granter: tx.From, Grantee: tx.To}
+	journal.recordFeeAllowance(key)
+	feeAllowances[key] = FeeAllowance{
+		Granter:         tx.From,
+		Grantee:         tx.To,
+		SpendLimit:      spendLimit,
+		Denom:           denomOrNative(denom),
+		Expiration:      int(expiration),
+		AllowedMessages: dataStrings(tx.Data, "messages"),
+	}
+
+	emitEvent(tx, "fee_grant", map[string]string{"granter": tx.From, "grantee": tx.To})
+
+	return nil
+}
+
+func RevokeFeeAllowanceTransaction(tx Transaction) error {
+	key := feeAllowanceKey{Granter: tx.From, Grantee: tx.To}
+	if _, ok := feeAllowances[key]; !ok {
+		return errors.New("fee allowance not found")
+	}
+
+	journal.recordFeeAllowance(key)
+	delete(feeAllowances, key)
+
+	emitEvent(tx, "fee_revoke", map[string]string{"granter": tx.From, "grantee": tx.To})
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckFeeAllowance(t *testing.T) {
+	sponsored := func(fee int64, txType string) Transaction {
+		return Transaction{Type: txType, From: "bob", To: "carol", FeePayer: "alice", Fee: NewAmount(fee)}
+	}
+
+	tests := []struct {
+		name      string
+		allowance FeeAllowance
+		tx        Transaction
+		height    int
+		valid     bool
+	}{
+		{"no limit", FeeAllowance{}, sponsored(500, "transfer"), 1, true},
+		{"within spend limit", FeeAllowance{SpendLimit: NewAmount(100), Spent: NewAmount(50)}, sponsored(50, "transfer"), 1, true},
+		{"beyond spend limit", FeeAllowance{SpendLimit: NewAmount(100), Spent: NewAmount(50)}, sponsored(51, "transfer"), 1, false},
+		{"at expiration", FeeAllowance{Expiration: 10}, sponsored(1, "transfer"), 10, true},
+		{"after expiration", FeeAllowance{Expiration: 10}, sponsored(1, "transfer"), 11, false},
+		{"allowed message", FeeAllowance{AllowedMessages: []string{"transfer"}}, sponsored(1, "transfer"), 1, true},
+		{"other message", FeeAllowance{AllowedMessages: []string{"transfer"}}, sponsored(1, "stake"), 1, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		allowance := tt.allowance
+		allowance.Granter, allowance.Grantee, allowance.Denom = "alice", "bob", NativeDenom
+		feeAllowances[feeAllowanceKey{Granter: "alice", Grantee: "bob"}] = allowance
+
+		err := checkFeeAllowance(tt.tx, tt.height)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: checkFeeAllowance() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestFeePayerSignature(t *testing.T) {
+	sender := NewWallet()
+	payer := NewWallet()
+	tx := sender.CreateSponsoredTransaction("carol", NewAmount(1), NewAmount(1), publicKeyToString(payer.PublicKey))
+
+	if bytes.Equal(feePayerHash(tx), transactionHash(tx)) {
+		t.Fatal("fee payer signs the same digest as the sender")
+	}
+
+	// A signature made as sender must not count as the fee payer's agreement
+	reused := tx
+	reused.FeePayerSignature = payer.signTransaction(tx)
+
+	signed, err := payer.SignAsFeePayer(tx)
+	if err != nil {
+		t.Fatalf("SignAsFeePayer() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		tx    Transaction
+		valid bool
+	}{
+		{"fee payer signature", signed, true},
+		{"sender signature reused", reused, false},
+	}
+
+	for _, tt := range tests {
+		if isValidFeePayer(tt.tx) != tt.valid {
+			t.Errorf("%s: isValidFeePayer() = %v, want %v", tt.name, !tt.valid, tt.valid)
+		}
+	}
+}
+
+func TestGrantFeeAllowanceTransaction(t *testing.T) {
+	grant := func(data map[string]interface{}) Transaction {
+		return Transaction{Type: "fee_grant", From: "alice", To: "bob", Data: data}
+	}
+
+	tests := []struct {
+		name  string
+		tx    Transaction
+		limit Amount
+		valid bool
+	}{
+		{"no limit", grant(map[string]interface{}{}), Amount{}, true},
+		{"spend limit", grant(map[string]interface{}{"spendLimit": "100"}), NewAmount(100), true},
+		{"zero spend limit", grant(map[string]interface{}{"spendLimit": "0"}), Amount{}, false},
+		{"malformed spend limit", grant(map[string]interface{}{"spendLimit": "lots"}), Amount{}, false},
+		{"negative expiration", grant(map[string]interface{}{"expiration": -1}), Amount{}, false},
+		{"unknown denomination", grant(map[string]interface{}{"denom": "unknown"}), Amount{}, false},
+		{"self grant", Transaction{Type: "fee_grant", From: "alice", To: "alice"}, Amount{}, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		err := GrantFeeAllowanceTransaction(tt.tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: GrantFeeAllowanceTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		allowance, ok := feeAllowances[feeAllowanceKey{Granter: "alice", Grantee: "bob"}]
+		if ok != tt.valid {
+			t.Errorf("%s: allowance stored = %v, want %v", tt.name, ok, tt.valid)
+			continue
+		}
+		if ok && (allowance.SpendLimit.Cmp(tt.limit) != 0 || allowance.Denom != NativeDenom) {
+			t.Errorf("%s: allowance = %+v, want a spend limit of %s", tt.name, allowance, tt.limit)
+		}
+	}
+}
+
+func TestSponsoredFeeUsesAllowance(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	addBalance("bob", NativeDenom, NewAmount(10))
+	key := feeAllowanceKey{Granter: "alice", Grantee: "bob"}
+	feeAllowances[key] = FeeAllowance{Granter: "alice", Grantee: "bob", SpendLimit: NewAmount(30), Denom: NativeDenom}
+
+	tx := Transaction{From: "bob", To: "carol", Amount: NewAmount(10), Fee: NewAmount(20), FeePayer: "alice"}
+	receipt := executeTransaction(tx, 1, 1000)
+	if receipt.Status != ReceiptSuccess {
+		t.Fatalf("status = %v, error = %q", receipt.Status, receipt.Error)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(80)) != 0 {
+		t.Errorf("granter balance = %s, want 80", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("grantee balance = %s, want 0", balance)
+	}
+	if spent := feeAllowances[key].Spent; spent.Cmp(NewAmount(20)) != 0 {
+		t.Errorf("allowance spent = %s, want 20", spent)
+	}
+
+	// The second fee would take the allowance past its limit
+	tx.Nonce = 1
+	addBalance("bob", NativeDenom, NewAmount(10))
+	if receipt := executeTransaction(tx, 2, 1001); receipt.Status != ReceiptInvalid {
+		t.Errorf("status = %v, want ReceiptInvalid beyond the spend limit", receipt.Status)
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(80)) != 0 {
+		t.Errorf("granter balance = %s, want 80", balance)
+	}
+}
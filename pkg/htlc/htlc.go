@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// An HTLC locks funds for a recipient under a hash and a timeout. The recipient
+// claims them by revealing the preimage of the hash before the timeout, after
+// which the sender can refund them. The preimage is published in the claim
+// event, so a swap daemon watching the chain can use it to complete the
+// other side of an atomic swap.
+type HTLC struct {
+	ID        string // operationID of the lock transaction and message
+	Sender    string
+	Recipient string
+	Amount    Amount
+	Denom     string
+	HashLock  string // Hex encoded SHA-256 hash of the preimage
+	Timeout   int    // Block height from which the funds can no longer be claimed, only refunded
+}
+
+var htlcs = make(map[string]HTLC)
+
+func GetHTLC(id string) (HTLC, error) {
+	htlc, ok := htlcs[id]
+	if !ok {
+		return HTLC{}, fmt.Errorf("htlc not found: %s", id)
+	}
+	return htlc, nil
+}
+
+func LockHTLCTransaction(tx Transaction) error {
+	if tx.To == "" {
+		return errors.New("invalid recipient")
+	}
+
+	if tx.Amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	hashLock, _ := tx.Data["hashlock"].(string)
+	decoded, err := hex.DecodeString(hashLock)
+	if err != nil || len(decoded) != sha256.Size {
+		return errors.New("invalid hash lock")
+	}
+
+	timeout, _ := dataInt(tx.Data, "timeout")
+	if int(timeout) <= tx.blockHeight {
+		return errors.New("timeout must be a future block height")
+	}
+
+	id := executionID(tx)
+	if _, ok := htlcs[id]; ok {
+		return fmt.Errorf("htlc already exists: %s", id)
+	}
+
+	// Hold the funds in escrow until they are claimed or refunded
+	err = spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	htlc := HTLC{
+		ID:        id,
+		Sender:    tx.From,
+		Recipient: tx.To,
+		Amount:    tx.Amount,
+		Denom:     denomOrNative(tx.Denom),
+		HashLock:  hex.EncodeToString(decoded), // Lower case, as claims compare against it
+		Timeout:   int(timeout),
+	}
+	journal.recordHTLC(htlc.ID)
+	htlcs[htlc.ID] = htlc
+
+	emitEvent(tx, "htlc_lock", map[string]string{
+		"id":        htlc.ID,
+		"sender":    htlc.Sender,
+		"recipient": htlc.Recipient,
+		"amount":    htlc.Amount.String(),
+		"denom":     htlc.Denom,
+		"hashlock":  htlc.HashLock,
+		"timeout":   strconv.Itoa(htlc.Timeout),
+	})
+
+	return nil
+}
+
+// ClaimHTLCTransaction pays the locked funds to the recipient. Anyone holding
+// the preimage can submit the claim, the funds always go to the recipient.
+func ClaimHTLCTransaction(tx Transaction) error {
+	id, _ := tx.Data["id"].(string)
+	htlc, err := GetHTLC(id)
+	if err != nil {
+		return err
+	}
+
+	if tx.blockHeight >= htlc.Timeout {
+		return errors.New("htlc has timed out")
+	}
+
+	preimage, _ := tx.Data["preimage"].(string)
+	decoded, err := hex.DecodeString(preimage)
+	if err != nil {
+		return errors.New("invalid preimage")
+	}
+
+	hashed := sha256.Sum256(decoded)
+	if hex.EncodeToString(hashed[:]) != htlc.HashLock {
+		return errors.New("preimage does not match hash lock")
+	}
+
+	err = addBalance(htlc.Recipient, htlc.Denom, htlc.Amount)
+	if err != nil {
+		return err
+	}
+	journal.recordHTLC(id)
+	delete(htlcs, id)
+
+	emitEvent(tx, "htlc_claim", map[string]string{
+		"id":        id,
+		"recipient": htlc.Recipient,
+		"preimage":  preimage,
+	})
+
+	return nil
+}
+
+func RefundHTLCTransaction(tx Transaction) error {
+	id, _ := tx.Data["id"].(string)
+	htlc, err := GetHTLC(id)
+	if err != nil {
+		return err
+	}
+
+	if tx.From != htlc.Sender {
+		return errors.New("only the sender can refund an htlc")
+	}
+
+	if tx.blockHeight < htlc.Timeout {
+		return errors.New("htlc has not timed out yet")
+	}
+
+	err = addBalance(htlc.Sender, htlc.Denom, htlc.Amount)
+	if err != nil {
+		return err
+	}
+	journal.recordHTLC(id)
+	delete(htlcs, id)
+
+	emitEvent(tx, "htlc_refund", map[string]string{
+		"id":     id,
+		"sender": htlc.Sender,
+	})
+
+	return nil
+}
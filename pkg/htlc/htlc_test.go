@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestLockHTLCIDs(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	hashed := sha256.Sum256([]byte("secret"))
+	msg := Message{
+		Type:   "htlc_lock",
+		To:     "bob",
+		Amount: NewAmount(10),
+		Data:   map[string]interface{}{"hashlock": hex.EncodeToString(hashed[:]), "timeout": 20},
+	}
+	tx := Transaction{From: "alice", Messages: []Message{msg, msg}, receipt: &Receipt{TxHash: "tx"}, blockHeight: 10}
+
+	tests := []struct {
+		name  string
+		tx    Transaction
+		valid bool
+	}{
+		{"first message", messageTransaction(tx, msg, 0), true},
+		{"identical second message", messageTransaction(tx, msg, 1), true},
+		{"first message again", messageTransaction(tx, msg, 0), false},
+	}
+
+	for _, tt := range tests {
+		err := LockHTLCTransaction(tt.tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: LockHTLCTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	if len(htlcs) != 2 {
+		t.Errorf("got %d htlcs, want 2", len(htlcs))
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(80)) != 0 {
+		t.Errorf("balance = %s, want 80", balance)
+	}
+}
+
+func TestClaimAndRefundHTLC(t *testing.T) {
+	hashed := sha256.Sum256([]byte("secret"))
+	preimage := hex.EncodeToString([]byte("secret"))
+
+	tests := []struct {
+		name   string
+		tx     Transaction
+		valid  bool
+		paidTo string
+	}{
+		{"claim before timeout", Transaction{Type: "htlc_claim", From: "carol", blockHeight: 19, Data: map[string]interface{}{"id": "id", "preimage": preimage}}, true, "bob"},
+		{"claim at timeout", Transaction{Type: "htlc_claim", From: "bob", blockHeight: 20, Data: map[string]interface{}{"id": "id", "preimage": preimage}}, false, ""},
+		{"claim with wrong preimage", Transaction{Type: "htlc_claim", From: "bob", blockHeight: 19, Data: map[string]interface{}{"id": "id", "preimage": "00"}}, false, ""},
+		{"refund at timeout", Transaction{Type: "htlc_refund", From: "alice", blockHeight: 20, Data: map[string]interface{}{"id": "id"}}, true, "alice"},
+		{"refund before timeout", Transaction{Type: "htlc_refund", From: "alice", blockHeight: 19, Data: map[string]interface{}{"id": "id"}}, false, ""},
+		{"refund by recipient", Transaction{Type: "htlc_refund", From: "bob", blockHeight: 20, Data: map[string]interface{}{"id": "id"}}, false, ""},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		htlcs["id"] = HTLC{
+			ID:        "id",
+			Sender:    "alice",
+			Recipient: "bob",
+			Amount:    NewAmount(10),
+			Denom:     NativeDenom,
+			HashLock:  hex.EncodeToString(hashed[:]),
+			Timeout:   20,
+		}
+
+		var err error
+		if tt.tx.Type == "htlc_claim" {
+			err = ClaimHTLCTransaction(tt.tx)
+		} else {
+			err = RefundHTLCTransaction(tt.tx)
+		}
+
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if tt.valid && getBalance(tt.paidTo, NativeDenom).Cmp(NewAmount(10)) != 0 {
+			t.Errorf("%s: funds were not paid to %s", tt.name, tt.paidTo)
+		}
+		if _, ok := htlcs["id"]; ok == tt.valid {
+			t.Errorf("%s: htlc kept = %v, want %v", tt.name, ok, !tt.valid)
+		}
+		if !tt.valid && len(balances) != 0 {
+			t.Errorf("%s: failed transaction paid out %v", tt.name, balances)
+		}
+	}
+}
+
+func TestUpperCaseHashLock(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	hashed := sha256.Sum256([]byte("secret"))
+	lock := Transaction{
+		Type:        "htlc_lock",
+		From:        "alice",
+		To:          "bob",
+		Amount:      NewAmount(10),
+		Data:        map[string]interface{}{"hashlock": strings.ToUpper(hex.EncodeToString(hashed[:])), "timeout": 20},
+		receipt:     &Receipt{TxHash: "tx"},
+		blockHeight: 10,
+	}
+	if err := LockHTLCTransaction(lock); err != nil {
+		t.Fatalf("LockHTLCTransaction() error = %v", err)
+	}
+
+	id := executionID(lock)
+	if htlc, err := GetHTLC(id); err != nil || htlc.HashLock != hex.EncodeToString(hashed[:]) {
+		t.Fatalf("hash lock = %q, %v, want it in lower case", htlc.HashLock, err)
+	}
+
+	claim := Transaction{Type: "htlc_claim", From: "bob", blockHeight: 11, Data: map[string]interface{}{"id": id, "preimage": hex.EncodeToString([]byte("secret"))}}
+	if err := ClaimHTLCTransaction(claim); err != nil {
+		t.Fatalf("ClaimHTLCTransaction() error = %v", err)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("recipient balance = %s, want 10", balance)
+	}
+}
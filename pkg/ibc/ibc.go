@@ -5,6 +5,7 @@ import (
 	"github.com/cosmos/ibc-go/modules/core/04-channel/types"
 	"github.com/cosmos/ibc-go/modules/core/keeper"
 	"encoding/json"
+	"fmt"
 )
 
 func handleIBCClientUpdate(ctx sdk.Context, k keeper.Keeper, msg *types.MsgUpdateClient) (*sdk.Result, error) {
@@ -82,18 +83,26 @@ func executePacketApplicationLogic(ctx sdk.Context, k keeper.Keeper, packet type
 }
 
 func handleTokenTransfer(ctx sdk.Context, k keeper.Keeper, data PacketData, packet types.Packet, channel types.Channel) error {
-	// Extract the sender, receiver and amount from the packet data
+	// Extract the sender, receiver, amount and denomination from the packet data
 	sender := data.Sender
 	receiver := data.Receiver
 	amount := data.Amount
+	denom := denomOrNative(data.Denom)
+
+	// Tokens of another chain are received as vouchers of the channel they came through
+	if !isKnownDenom(denom) {
+		voucher := registerIBCVoucher(packet.GetDestPort(), packet.GetDestChannel(), denom)
+		return addBalance(receiver, voucher, amount)
+	}
 
 	// Deduct the tokens from the sender's account
-	balances[sender] -= amount
+	err := subBalance(sender, denom, amount)
+	if err != nil {
+		return err
+	}
 
 	// Add the tokens to the receiver's account
-	balances[receiver] += amount
-
-	return nil
+	return addBalance(receiver, denom, amount)
 }
 
 func handleSmartContractExecution(ctx sdk.Context, k keeper.Keeper, data PacketData, packet types.Packet, channel types.Channel) error {
@@ -108,19 +117,7 @@ func handleSmartContractExecution(ctx sdk.Context, k keeper.Keeper, data PacketD
 	}
 
 	// Execute the smart contract
-	vm, err := exec.NewVirtualMachine(sc.Code, exec.VMConfig{}, nil, nil)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	_, err = vm.Run(sc.Code)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	return nil
+	return executeContractMessage(data.Sender, sc, int(ctx.BlockHeight()), ctx.BlockTime().Unix())
 }
 
 func handleIBCPacketAcknowledgement(ctx sdk.Context, k keeper.Keeper, msg *types.MsgAcknowledgement) (*sdk.Result, error) {
@@ -177,41 +174,28 @@ func executeAcknowledgementApplicationLogic(ctx sdk.Context, k keeper.Keeper, pa
 }
 
 func handleTokenTransferAcknowledgement(ctx sdk.Context, k keeper.Keeper, packet types.Packet, ack Acknowledgement) error {
-	// Extract the sender, receiver and amount from the acknowledgement
+	// Extract the sender, receiver, amount and denomination from the acknowledgement
 	sender := ack.Sender
 	receiver := ack.Receiver
 	amount := ack.Amount
+	denom := denomOrNative(ack.Denom)
 
 	// Update the balances of the sender and receiver
-	balances[sender] -= amount
-	balances[receiver] += amount
-
-	return nil
-}
-
-func handleSmartContractExecutionAcknowledgement(ctx sdk.Context, k keeper.Keeper, packet types.Packet, ack Acknowledgement) error {
-	// Extract the contract and parameters from the acknowledgement
-	contract := ack.Contract
-	parameters := ack.Parameters
-
-	// Create a new instance of the smart contract
-	sc := SmartContract{
-		Code: contract,
-		Data: parameters,
-	}
-
-	// Execute the smart contract
-	vm, err := exec.NewVirtualMachine(sc.Code, exec.VMConfig{}, nil, nil)
+	err := subBalance(sender, denom, amount)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	return addBalance(receiver, denom, amount)
+}
 
-	_, err = vm.Run(sc.Code)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+func handleSmartContractExecutionAcknowledgement(ctx sdk.Context, k keeper.Keeper, packet types.Packet, ack Acknowledgement) error {
+	// The contract ran when the packet was received, the acknowledgement only confirms it.
+	// Running it again here would apply its effects a second time.
+	ctx.EventManager().EmitEvent(sdk.NewEvent(
+		"contract_acknowledgement",
+		sdk.NewAttribute("packet_sequence", fmt.Sprint(packet.GetSequence())),
+		sdk.NewAttribute("sender", ack.Sender),
+	))
 
 	return nil
 }
@@ -268,18 +252,20 @@ func executeTimeoutApplicationLogic(ctx sdk.Context, k keeper.Keeper, packet typ
 }
 
 func revertTokenTransfer(ctx sdk.Context, k keeper.Keeper, data PacketData, packet types.Packet) error {
-	// Extract the sender, receiver and amount from the packet data
+	// Extract the sender, receiver, amount and denomination from the packet data
 	sender := data.Sender
 	receiver := data.Receiver
 	amount := data.Amount
-
-	// Add the tokens back to the sender's account
-	balances[sender] += amount
+	denom := denomOrNative(data.Denom)
 
 	// Deduct the tokens from the receiver's account
-	balances[receiver] -= amount
+	err := subBalance(receiver, denom, amount)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	// Add the tokens back to the sender's account
+	return addBalance(sender, denom, amount)
 }
 
 
@@ -300,13 +286,20 @@ func revertSmartContractExecution(ctx sdk.Context, k keeper.Keeper, data PacketD
 	if sc.Data["action"] == "transfer" {
 		sender := sc.Data["from"].(string)
 		receiver := sc.Data["to"].(string)
-		amount := sc.Data["amount"].(int)
-
-		// Add the tokens back to the sender's account
-		balances[sender] += amount
+		amount, _ := dataAmount(sc.Data, "amount")
+		denom, _ := sc.Data["denom"].(string)
 
 		// Deduct the tokens from the receiver's account
-		balances[receiver] -= amount
+		err := subBalance(receiver, denom, amount)
+		if err != nil {
+			return err
+		}
+
+		// Add the tokens back to the sender's account
+		err = addBalance(sender, denom, amount)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
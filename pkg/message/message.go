@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A Message is a single operation inside a multi-message transaction.
+// It is executed on behalf of the sender of the enclosing transaction.
+type Message struct {
+	Type     string // Key in TransactionTypes
+	To       string
+	Amount   Amount
+	Denom    string
+	Contract *SmartContract
+	Data     map[string]interface{}
+}
+
+func transactionType(tx Transaction) string {
+	if tx.Type != "" {
+		return tx.Type
+	}
+
+	if tx.Contract != nil {
+		return "contract"
+	}
+
+	return "transfer"
+}
+
+// messageTransaction turns the message at index i into a transaction that can be passed to its handler
+func messageTransaction(tx Transaction, msg Message, i int) Transaction {
+	return Transaction{
+		Type:        msg.Type,
+		From:        tx.From,
+		To:          msg.To,
+		Amount:      msg.Amount,
+		Denom:       msg.Denom,
+		Contract:    msg.Contract,
+		Data:        msg.Data,
+		GasLimit:    tx.GasLimit,
+		receipt:     tx.receipt,
+		message:     i + 1,
+		blockHeight: tx.blockHeight,
+		blockTime:   tx.blockTime,
+	}
+}
+
+// operationID derives the ID of an object created by a transaction, such as an escrow.
+// Every message of a transaction gets its own ID, even when two messages are identical.
+func operationID(txHash string, message int) string {
+	hashed := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", txHash, message)))
+	return hex.EncodeToString(hashed[:])
+}
+
+// executionID is the operationID of the transaction or message being executed
+func executionID(tx Transaction) string {
+	txHash := TransactionHash(tx)
+	if tx.receipt != nil {
+		txHash = tx.receipt.TxHash
+	}
+	return operationID(txHash, tx.message)
+}
+
+// dataInt reads an integer from transaction data, which holds float64 values once decoded from JSON
+func dataInt(data map[string]interface{}, key string) (int64, bool) {
+	switch v := data[key].(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// dataStrings reads a list of strings from transaction data
+func dataStrings(data map[string]interface{}, key string) []string {
+	switch v := data[key].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// dataValue decodes structured transaction data, which is a plain map once decoded from JSON
+func dataValue(data map[string]interface{}, key string, out interface{}) error {
+	value, ok := data[key]
+	if !ok {
+		return fmt.Errorf("missing %s", key)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(encoded, out)
+}
+
+// transactionTypes returns the types of every operation carried by a transaction
+func transactionTypes(tx Transaction) []string {
+	if len(tx.Messages) == 0 {
+		return []string{transactionType(tx)}
+	}
+
+	types := make([]string, len(tx.Messages))
+	for i, msg := range tx.Messages {
+		types[i] = msg.Type
+	}
+	return types
+}
+
+func dispatchTransaction(tx Transaction) error {
+	txType := transactionType(tx)
+
+	handler, ok := TransactionTypes[txType]
+	if !ok {
+		return fmt.Errorf("unknown transaction type: %s", txType)
+	}
+
+	return handler(tx)
+}
+
+// applyTransaction executes a transaction through the TransactionTypes registry.
+// All of its messages succeed or the state is rolled back to how it was before.
+func applyTransaction(tx Transaction) error {
+	// Plain transfers may run concurrently and never leave partial changes, so they skip the journal
+	if isPlainTransfer(tx) {
+		return dispatchTransaction(tx)
+	}
+
+	return journaled(false, func() error {
+		// Transactions executed under an authorization act on the granter's account
+		if tx.Granter != "" {
+			err := useAuthorization(tx, tx.blockHeight, tx.blockTime)
+			if err != nil {
+				return err
+			}
+			tx.From = tx.Granter
+		}
+
+		if len(tx.Messages) == 0 {
+			return dispatchTransaction(tx)
+		}
+
+		for i, msg := range tx.Messages {
+			err := dispatchTransaction(messageTransaction(tx, msg, i))
+			if err != nil {
+				return fmt.Errorf("message %d (%s) failed: %v", i, msg.Type, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func StakeTransaction(tx Transaction) error {
+	if tx.Amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	if denomOrNative(tx.Denom) != NativeDenom {
+		return errors.New("only the native coin can be staked")
+	}
+
+	err := subBalance(tx.From, NativeDenom, tx.Amount)
+	if err != nil {
+		return errors.New("insufficient balance to stake")
+	}
+
+	err = trackDelegation(tx.From, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	stake, err := validators[tx.From].Add(tx.Amount)
+	if err != nil {
+		return err
+	}
+	journal.recordValidator(tx.From)
+	validators[tx.From] = stake
+
+	return nil
+}
+
+func UnstakeTransaction(tx Transaction) error {
+	if tx.Amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	if denomOrNative(tx.Denom) != NativeDenom {
+		return errors.New("only the native coin can be staked")
+	}
+
+	stake, err := validators[tx.From].Sub(tx.Amount)
+	if err != nil {
+		return errors.New("insufficient stake")
+	}
+
+	journal.recordValidator(tx.From)
+	if stake.IsZero() {
+		delete(validators, tx.From)
+	} else {
+		validators[tx.From] = stake
+	}
+
+	err = trackUndelegation(tx.From, tx.Amount)
+	if err != nil {
+		return err
+	}
+
+	return addBalance(tx.From, NativeDenom, tx.Amount)
+}
+
+func VoteTransaction(tx Transaction) error {
+	proposalID, ok := tx.Data["proposal"].(string)
+	if !ok {
+		return errors.New("invalid proposal")
+	}
+
+	vote, ok := tx.Data["vote"].(bool)
+	if !ok {
+		return errors.New("invalid vote")
+	}
+
+	// Only accounts with bonded stake vote, so votes cannot be multiplied by creating accounts
+	if _, ok := validators[tx.From]; !ok {
+		return errors.New("only validators can vote")
+	}
+
+	return Vote(Node{ID: tx.From, Address: tx.From}, proposalID, vote)
+}
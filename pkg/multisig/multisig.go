@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const multisigPrefix = "multisig:"
+
+type MultisigAccount struct {
+	Threshold  int
+	PublicKeys []string // PEM encoded public keys, kept sorted
+}
+
+func NewMultisigAccount(threshold int, publicKeys []string) (*MultisigAccount, error) {
+	if len(publicKeys) == 0 {
+		return nil, errors.New("multisig account needs at least one public key")
+	}
+
+	if threshold < 1 || threshold > len(publicKeys) {
+		return nil, fmt.Errorf("invalid threshold %d for %d keys", threshold, len(publicKeys))
+	}
+
+	// Sort the keys so the same set always yields the same address
+	keys := make([]string, len(publicKeys))
+	copy(keys, publicKeys)
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if convertPublicKey(key) == nil {
+			return nil, errors.New("invalid public key in multisig account")
+		}
+
+		if i > 0 && keys[i-1] == key {
+			return nil, errors.New("duplicate public key in multisig account")
+		}
+	}
+
+	return &MultisigAccount{Threshold: threshold, PublicKeys: keys}, nil
+}
+
+// Address commits to the threshold and the set of public keys of the account
+func (m *MultisigAccount) Address() string {
+	record := fmt.Sprintf("%d", m.Threshold) + strings.Join(m.PublicKeys, "")
+	hashed := sha256.Sum256([]byte(record))
+	return multisigPrefix + hex.EncodeToString(hashed[:])
+}
+
+func (m *MultisigAccount) HasKey(pubKey string) bool {
+	for _, key := range m.PublicKeys {
+		if key == pubKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidMultisig(tx Transaction) bool {
+	// The sender must be the address the account commits to
+	if tx.Multisig.Address() != tx.From {
+		return false
+	}
+
+	hashed := transactionHash(tx)
+	if hashed == nil {
+		return false
+	}
+
+	// Count the valid signatures of distinct account keys
+	valid := 0
+	for key, sig := range tx.Signatures {
+		if !tx.Multisig.HasKey(key) {
+			return false
+		}
+
+		pubKey := convertPublicKey(key)
+		if pubKey == nil || !verifySignature(pubKey, hashed, sig) {
+			return false
+		}
+		valid++
+	}
+
+	return valid >= tx.Multisig.Threshold
+}
@@ -0,0 +1,123 @@
+package main
+
+import "testing"
+
+func TestIsValidMultisig(t *testing.T) {
+	signers := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	outsider := NewWallet()
+
+	var keys []string
+	for _, w := range signers {
+		keys = append(keys, publicKeyToString(w.PublicKey))
+	}
+	account, err := NewMultisigAccount(2, keys)
+	if err != nil {
+		t.Fatalf("NewMultisigAccount() error = %v", err)
+	}
+
+	sign := func(wallets ...*Wallet) Transaction {
+		tx := NewMultisigTransaction(account, "carol", NewAmount(1))
+		for _, w := range wallets {
+			signature := w.signTransaction(tx)
+			tx.Signatures[publicKeyToString(w.PublicKey)] = signature
+		}
+		return tx
+	}
+
+	tampered := sign(signers[0], signers[1])
+	tampered.Amount = NewAmount(2)
+
+	otherSender := sign(signers[0], signers[1])
+	otherSender.From = "carol"
+
+	tests := []struct {
+		name  string
+		tx    Transaction
+		valid bool
+	}{
+		{"threshold met", sign(signers[0], signers[1]), true},
+		{"all signers", sign(signers...), true},
+		{"below threshold", sign(signers[2]), false},
+		{"outsider signature", sign(signers[0], outsider), false},
+		{"tampered transaction", tampered, false},
+		{"sender is not the account", otherSender, false},
+	}
+
+	for _, tt := range tests {
+		if isValidMultisig(tt.tx) != tt.valid {
+			t.Errorf("%s: isValidMultisig() = %v, want %v", tt.name, !tt.valid, tt.valid)
+		}
+	}
+}
+
+func TestNewMultisigAccount(t *testing.T) {
+	a := publicKeyToString(NewWallet().PublicKey)
+	b := publicKeyToString(NewWallet().PublicKey)
+
+	tests := []struct {
+		name      string
+		threshold int
+		keys      []string
+		valid     bool
+	}{
+		{"valid", 2, []string{a, b}, true},
+		{"threshold above key count", 3, []string{a, b}, false},
+		{"zero threshold", 0, []string{a, b}, false},
+		{"duplicate key", 2, []string{a, a}, false},
+		{"invalid key", 1, []string{"key"}, false},
+		{"no keys", 1, nil, false},
+	}
+
+	for _, tt := range tests {
+		_, err := NewMultisigAccount(tt.threshold, tt.keys)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: NewMultisigAccount() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	first, _ := NewMultisigAccount(2, []string{a, b})
+	second, _ := NewMultisigAccount(2, []string{b, a})
+	if first.Address() != second.Address() {
+		t.Errorf("key order changes the address: %s and %s", first.Address(), second.Address())
+	}
+}
+
+func TestCombineSignatures(t *testing.T) {
+	signers := []*Wallet{NewWallet(), NewWallet()}
+	keys := []string{publicKeyToString(signers[0].PublicKey), publicKeyToString(signers[1].PublicKey)}
+	account, err := NewMultisigAccount(2, keys)
+	if err != nil {
+		t.Fatalf("NewMultisigAccount() error = %v", err)
+	}
+
+	tx := NewMultisigTransaction(account, "carol", NewAmount(1))
+	first, err := signers[0].SignMultisigTransaction(tx)
+	if err != nil {
+		t.Fatalf("SignMultisigTransaction() error = %v", err)
+	}
+	second, err := signers[1].SignMultisigTransaction(tx)
+	if err != nil {
+		t.Fatalf("SignMultisigTransaction() error = %v", err)
+	}
+
+	if len(tx.Signatures) != 0 {
+		t.Errorf("signing changed the unsigned transaction: %v", tx.Signatures)
+	}
+	if isValidMultisig(first) {
+		t.Errorf("one signature passed a threshold of two")
+	}
+
+	combined, err := CombineSignatures(first, second)
+	if err != nil {
+		t.Fatalf("CombineSignatures() error = %v", err)
+	}
+	if len(combined.Signatures) != 2 || !isValidMultisig(combined) {
+		t.Errorf("combined transaction has %d signatures and valid %v, want 2 and true", len(combined.Signatures), isValidMultisig(combined))
+	}
+
+	other := second
+	other.Amount = NewAmount(2)
+	if _, err := CombineSignatures(first, other); err == nil {
+		t.Errorf("CombineSignatures() merged different transactions")
+	}
+}
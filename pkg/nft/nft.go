@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A Collection groups NFTs issued by the same creator, for example the certificates
+// of one program. Only the creator of a collection can mint NFTs in it.
+type Collection struct {
+	ID          string
+	Name        string
+	Description string
+	Creator     string
+}
+
+// An NFT is a non-fungible item owned by one account. Its metadata lives off-chain
+// at URI and URIHash lets holders check that it has not been changed.
+type NFT struct {
+	Collection string
+	ID         string // Unique within the collection
+	Owner      string
+	URI        string
+	URIHash    string // Hex encoded SHA-256 hash of the metadata at URI, empty if not given
+	Approved   string // Account that may transfer the NFT for the owner, empty for none
+}
+
+type nftKey struct {
+	Collection string
+	ID         string
+}
+
+var nftCollections = make(map[string]Collection)
+
+var nfts = make(map[nftKey]NFT)
+
+// Index the NFTs by owner and by collection, so listing them does not scan every NFT
+var nftsByOwner = make(map[string]map[nftKey]bool)
+var nftsByCollection = make(map[string]map[nftKey]bool)
+
+func addToNFTIndex(index map[string]map[nftKey]bool, name string, key nftKey) {
+	if index[name] == nil {
+		index[name] = make(map[nftKey]bool)
+	}
+	index[name][key] = true
+}
+
+func removeFromNFTIndex(index map[string]map[nftKey]bool, name string, key nftKey) {
+	delete(index[name], key)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+func GetCollection(id string) (Collection, error) {
+	collection, ok := nftCollections[id]
+	if !ok {
+		return Collection{}, fmt.Errorf("collection not found: %s", id)
+	}
+	return collection, nil
+}
+
+func GetNFT(collection string, id string) (NFT, error) {
+	nft, ok := nfts[nftKey{Collection: collection, ID: id}]
+	if !ok {
+		return NFT{}, fmt.Errorf("nft not found: %s/%s", collection, id)
+	}
+	return nft, nil
+}
+
+// NFTsByOwner returns the NFTs of an account sorted by collection and ID
+func NFTsByOwner(owner string) []NFT {
+	return indexedNFTs(nftsByOwner[owner])
+}
+
+// NFTsByCollection returns the NFTs of a collection sorted by ID
+func NFTsByCollection(collection string) []NFT {
+	return indexedNFTs(nftsByCollection[collection])
+}
+
+func indexedNFTs(keys map[nftKey]bool) []NFT {
+	var found []NFT
+	for key := range keys {
+		found = append(found, nfts[key])
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Collection != found[j].Collection {
+			return found[i].Collection < found[j].Collection
+		}
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+// nftFromData returns the NFT named by the "collection" and "id" data keys of a transaction
+func nftFromData(tx Transaction) (NFT, error) {
+	collection, _ := tx.Data["collection"].(string)
+	id, _ := tx.Data["id"].(string)
+	return GetNFT(collection, id)
+}
+
+func CreateCollectionTransaction(tx Transaction) error {
+	id, ok := tx.Data["id"].(string)
+	if !ok || id == "" {
+		return errors.New("invalid collection id")
+	}
+
+	if _, ok := nftCollections[id]; ok {
+		return fmt.Errorf("collection already exists: %s", id)
+	}
+
+	name, _ := tx.Data["name"].(string)
+	description, _ := tx.Data["description"].(string)
+
+	journal.recordCollection(id)
+	nftCollections[id] = Collection{
+		ID:          id,
+		Name:        name,
+		Description: description,
+		Creator:     tx.From,
+	}
+
+	emitEvent(tx, "nft_collection_create", map[string]string{"collection": id, "creator": tx.From})
+
+	return nil
+}
+
+// MintNFTTransaction mints an NFT owned by tx.To, or by the sender when it is empty
+func MintNFTTransaction(tx Transaction) error {
+	collectionID, _ := tx.Data["collection"].(string)
+	collection, err := GetCollection(collectionID)
+	if err != nil {
+		return err
+	}
+
+	if tx.From != collection.Creator {
+		return errors.New("only the collection creator can mint")
+	}
+
+	id, ok := tx.Data["id"].(string)
+	if !ok || id == "" {
+		return errors.New("invalid nft id")
+	}
+
+	key := nftKey{Collection: collection.ID, ID: id}
+	if _, ok := nfts[key]; ok {
+		return fmt.Errorf("nft already exists: %s/%s", collection.ID, id)
+	}
+
+	uri, _ := tx.Data["uri"].(string)
+	uriHash, _ := tx.Data["uriHash"].(string)
+	if uriHash != "" {
+		decoded, err := hex.DecodeString(uriHash)
+		if err != nil || len(decoded) != 32 {
+			return errors.New("invalid uri hash")
+		}
+	}
+
+	owner := tx.To
+	if owner == "" {
+		owner = tx.From
+	}
+
+	journal.recordNFT(key)
+	nfts[key] = NFT{
+		Collection: collection.ID,
+		ID:         id,
+		Owner:      owner,
+		URI:        uri,
+		URIHash:    uriHash,
+	}
+	addToNFTIndex(nftsByOwner, owner, key)
+	addToNFTIndex(nftsByCollection, collection.ID, key)
+
+	emitEvent(tx, "nft_mint", map[string]string{"collection": collection.ID, "id": id, "owner": owner})
+
+	return nil
+}
+
+// TransferNFTTransaction moves an NFT to tx.To. The owner or the approved account can
+// transfer it, and the approval does not carry over to the new owner.
+func TransferNFTTransaction(tx Transaction) error {
+	nft, err := nftFromData(tx)
+	if err != nil {
+		return err
+	}
+
+	if tx.From != nft.Owner && (nft.Approved == "" || tx.From != nft.Approved) {
+		return errors.New("not allowed to transfer the nft")
+	}
+
+	if tx.To == "" {
+		return errors.New("invalid recipient")
+	}
+
+	key := nftKey{Collection: nft.Collection, ID: nft.ID}
+	from := nft.Owner
+	nft.Owner = tx.To
+	nft.Approved = ""
+	journal.recordNFT(key)
+	nfts[key] = nft
+	removeFromNFTIndex(nftsByOwner, from, key)
+	addToNFTIndex(nftsByOwner, nft.Owner, key)
+
+	emitEvent(tx, "nft_transfer", map[string]string{
+		"collection": nft.Collection,
+		"id":         nft.ID,
+		"from":       from,
+		"to":         tx.To,
+	})
+
+	return nil
+}
+
+// ApproveNFTTransaction lets tx.To transfer the NFT, an empty tx.To removes the approval
+func ApproveNFTTransaction(tx Transaction) error {
+	nft, err := nftFromData(tx)
+	if err != nil {
+		return err
+	}
+
+	if tx.From != nft.Owner {
+		return errors.New("only the owner can approve a transfer of the nft")
+	}
+
+	nft.Approved = tx.To
+	key := nftKey{Collection: nft.Collection, ID: nft.ID}
+	journal.recordNFT(key)
+	nfts[key] = nft
+
+	emitEvent(tx, "nft_approve", map[string]string{"collection": nft.Collection, "id": nft.ID, "approved": tx.To})
+
+	return nil
+}
+
+func BurnNFTTransaction(tx Transaction) error {
+	nft, err := nftFromData(tx)
+	if err != nil {
+		return err
+	}
+
+	if tx.From != nft.Owner {
+		return errors.New("only the owner can burn the nft")
+	}
+
+	key := nftKey{Collection: nft.Collection, ID: nft.ID}
+	journal.recordNFT(key)
+	delete(nfts, key)
+	removeFromNFTIndex(nftsByOwner, nft.Owner, key)
+	removeFromNFTIndex(nftsByCollection, nft.Collection, key)
+
+	emitEvent(tx, "nft_burn", map[string]string{"collection": nft.Collection, "id": nft.ID, "owner": nft.Owner})
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import "testing"
+
+func TestNFTTransitions(t *testing.T) {
+	resetState()
+	CreateCollectionTransaction(Transaction{From: "alice", Data: map[string]interface{}{"id": "art"}})
+
+	nft := func(from string, to string) Transaction {
+		return Transaction{From: from, To: to, Data: map[string]interface{}{"collection": "art", "id": "1"}}
+	}
+
+	tests := []struct {
+		name    string
+		handler func(Transaction) error
+		tx      Transaction
+		valid   bool
+		owner   string // Owner afterwards, empty once burned
+	}{
+		{"other account mints", MintNFTTransaction, nft("bob", "bob"), false, ""},
+		{"creator mints", MintNFTTransaction, nft("alice", "bob"), true, "bob"},
+		{"mint existing id", MintNFTTransaction, nft("alice", "alice"), false, "bob"},
+		{"other account transfers", TransferNFTTransaction, nft("carol", "carol"), false, "bob"},
+		{"owner approves", ApproveNFTTransaction, nft("bob", "carol"), true, "bob"},
+		{"approved account transfers", TransferNFTTransaction, nft("carol", "dave"), true, "dave"},
+		{"approval does not carry over", TransferNFTTransaction, nft("carol", "carol"), false, "dave"},
+		{"other account burns", BurnNFTTransaction, nft("bob", ""), false, "dave"},
+		{"owner burns", BurnNFTTransaction, nft("dave", ""), true, ""},
+	}
+
+	for _, tt := range tests {
+		err := tt.handler(tt.tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+
+		owned := NFTsByCollection("art")
+		if tt.owner == "" {
+			if len(owned) != 0 || len(nftsByOwner) != 0 {
+				t.Errorf("%s: nft still indexed after burn", tt.name)
+			}
+			continue
+		}
+
+		if len(owned) != 1 || owned[0].Owner != tt.owner {
+			t.Errorf("%s: collection lists %v, want one nft owned by %s", tt.name, owned, tt.owner)
+		}
+		if byOwner := NFTsByOwner(tt.owner); len(byOwner) != 1 || len(nftsByOwner) != 1 {
+			t.Errorf("%s: owner index %v does not match the owner %s", tt.name, nftsByOwner, tt.owner)
+		}
+	}
+}
+
+func TestNFTsByOwnerSorted(t *testing.T) {
+	resetState()
+	CreateCollectionTransaction(Transaction{From: "alice", Data: map[string]interface{}{"id": "b"}})
+	CreateCollectionTransaction(Transaction{From: "alice", Data: map[string]interface{}{"id": "a"}})
+	for _, key := range []nftKey{{"b", "1"}, {"a", "2"}, {"a", "1"}} {
+		MintNFTTransaction(Transaction{From: "alice", Data: map[string]interface{}{"collection": key.Collection, "id": key.ID}})
+	}
+
+	owned := NFTsByOwner("alice")
+	want := []nftKey{{"a", "1"}, {"a", "2"}, {"b", "1"}}
+	if len(owned) != len(want) {
+		t.Fatalf("got %d nfts, want %d", len(owned), len(want))
+	}
+	for i, key := range want {
+		if owned[i].Collection != key.Collection || owned[i].ID != key.ID {
+			t.Errorf("nft %d is %s/%s, want %s/%s", i, owned[i].Collection, owned[i].ID, key.Collection, key.ID)
+		}
+	}
+}
+
+func TestFailedNFTTransactionRollsBack(t *testing.T) {
+	resetState()
+	CreateCollectionTransaction(Transaction{From: "alice", Data: map[string]interface{}{"id": "art"}})
+	MintNFTTransaction(Transaction{From: "alice", Data: map[string]interface{}{"collection": "art", "id": "1"}})
+
+	// The transfer and the second mint are undone when the last message fails
+	tx := Transaction{
+		From: "alice",
+		Messages: []Message{
+			{Type: "nft_transfer", To: "bob", Data: map[string]interface{}{"collection": "art", "id": "1"}},
+			{Type: "nft_mint", Data: map[string]interface{}{"collection": "art", "id": "2"}},
+			{Type: "nft_burn", Data: map[string]interface{}{"collection": "art", "id": "1"}},
+		},
+	}
+	if err := applyTransaction(tx); err == nil {
+		t.Fatal("applyTransaction() error = nil, want the burn by the former owner to fail")
+	}
+
+	if nft, err := GetNFT("art", "1"); err != nil || nft.Owner != "alice" {
+		t.Errorf("nft = %+v, %v, want it still owned by alice", nft, err)
+	}
+	if _, err := GetNFT("art", "2"); err == nil {
+		t.Error("second mint was not rolled back")
+	}
+	if owned := NFTsByOwner("alice"); len(owned) != 1 || len(nftsByOwner) != 1 {
+		t.Errorf("owner index = %v, want only alice's nft", nftsByOwner)
+	}
+	if owned := NFTsByCollection("art"); len(owned) != 1 {
+		t.Errorf("collection lists %v, want one nft", owned)
+	}
+}
+
+func TestRestoreSnapshotRestoresNFTIndexes(t *testing.T) {
+	resetState()
+	CreateCollectionTransaction(Transaction{From: "alice", Data: map[string]interface{}{"id": "art"}})
+	MintNFTTransaction(Transaction{From: "alice", Data: map[string]interface{}{"collection": "art", "id": "1"}})
+	snapshot := takeSnapshot()
+
+	TransferNFTTransaction(Transaction{From: "alice", To: "bob", Data: map[string]interface{}{"collection": "art", "id": "1"}})
+	MintNFTTransaction(Transaction{From: "alice", Data: map[string]interface{}{"collection": "art", "id": "2"}})
+	restoreSnapshot(snapshot)
+
+	if owned := NFTsByOwner("alice"); len(owned) != 1 || owned[0].ID != "1" {
+		t.Errorf("alice owns %v, want nft 1", owned)
+	}
+	if owned := NFTsByOwner("bob"); len(owned) != 0 {
+		t.Errorf("bob owns %v after the restore", owned)
+	}
+	if owned := NFTsByCollection("art"); len(owned) != 1 {
+		t.Errorf("collection lists %v, want one nft", owned)
+	}
+}
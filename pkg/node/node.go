@@ -7,8 +7,94 @@ import (
 	"log"
 	"io"
 	"bufio"
+	"fmt"
+	"strings"
+	"encoding/json"
+	"errors"
 )
 
+// Transactions waiting to be included in a block
+var pendingTransactions []Transaction
+
+func addPendingTransaction(tx Transaction) error {
+	stateMutex.Lock()
+	valid := isTransactionValid(tx)
+	stateMutex.Unlock()
+
+	if !valid {
+		return errors.New("invalid transaction")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, pending := range pendingTransactions {
+		if pending.From == tx.From && pending.Nonce == tx.Nonce {
+			return errors.New("a transaction with the same nonce is pending")
+		}
+	}
+
+	pendingTransactions = append(pendingTransactions, tx)
+	return nil
+}
+
+// nextNonce returns the nonce of the next transaction of an account, after its pending ones
+func nextNonce(account string) uint64 {
+	stateMutex.Lock()
+	nonce := accountNonces[account]
+	stateMutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, tx := range pendingTransactions {
+		if tx.From == account && tx.Nonce >= nonce {
+			nonce = tx.Nonce + 1
+		}
+	}
+	return nonce
+}
+
+// takePendingTransactions drops the expired transactions from the pending set
+// and returns the ones that can still be included in a block at the given height
+func takePendingTransactions(height int) []Transaction {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var remaining []Transaction
+	for _, tx := range pendingTransactions {
+		if !isExpired(tx, height) {
+			remaining = append(remaining, tx)
+		}
+	}
+	pendingTransactions = remaining
+
+	return append([]Transaction(nil), remaining...)
+}
+
+// prunePendingTransactions drops the transactions included in a block
+// and the ones that can no longer be included after it
+func prunePendingTransactions(block Block) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	included := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		included[TransactionHash(tx)] = true
+	}
+
+	var remaining []Transaction
+	for _, tx := range pendingTransactions {
+		if included[TransactionHash(tx)] || isExpired(tx, block.Index+1) || tx.Nonce < accountNonces[tx.From] {
+			continue
+		}
+		remaining = append(remaining, tx)
+	}
+	pendingTransactions = remaining
+}
 
 
 func handleConnection(conn net.Conn) {
@@ -19,9 +105,96 @@ func handleConnection(conn net.Conn) {
 
 	for scanner.Scan() {
 		msg := scanner.Text()
-		switch msg {
-		case "get blockchain":
+		switch {
+		case msg == "get blockchain":
 			broadcastChain()
+		case strings.HasPrefix(msg, "get receipt "):
+			receipt, err := GetReceipt(strings.TrimPrefix(msg, "get receipt "))
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+
+			encoded, err := json.Marshal(receipt)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", encoded))
+		case strings.HasPrefix(msg, "get token "):
+			stateMutex.Lock()
+			token, err := GetToken(strings.TrimPrefix(msg, "get token "))
+			stateMutex.Unlock()
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+
+			encoded, err := json.Marshal(token)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", encoded))
+		case strings.HasPrefix(msg, "get nfts owner "), strings.HasPrefix(msg, "get nfts collection "):
+			var found []NFT
+			stateMutex.Lock()
+			if strings.HasPrefix(msg, "get nfts owner ") {
+				found = NFTsByOwner(strings.TrimPrefix(msg, "get nfts owner "))
+			} else {
+				found = NFTsByCollection(strings.TrimPrefix(msg, "get nfts collection "))
+			}
+			stateMutex.Unlock()
+
+			encoded, err := json.Marshal(found)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", encoded))
+		case strings.HasPrefix(msg, "send transaction "):
+			tx, err := ImportTransaction(strings.TrimPrefix(msg, "send transaction "))
+			if err == nil {
+				err = addPendingTransaction(tx)
+			}
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", TransactionHash(tx)))
+		case strings.HasPrefix(msg, "query contract "):
+			var query ContractQuery
+			err := json.Unmarshal([]byte(strings.TrimPrefix(msg, "query contract ")), &query)
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+
+			result, err := QueryContract(query)
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+
+			encoded, err := json.Marshal(result)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", encoded))
+		case strings.HasPrefix(msg, "simulate transaction "):
+			tx, err := ImportTransaction(strings.TrimPrefix(msg, "simulate transaction "))
+			if err != nil {
+				io.WriteString(conn, fmt.Sprintf("\n%v\n", err))
+				continue
+			}
+
+			encoded, err := json.Marshal(SimulateTransaction(tx))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			io.WriteString(conn, fmt.Sprintf("\n%s\n", encoded))
 		default:
 			io.WriteString(conn, "\nEnter a new BPM:")
 
@@ -32,14 +205,28 @@ func handleConnection(conn net.Conn) {
 				return
 			}
 
-			newBlock, err := createBlock(Blockchain[len(Blockchain)-1], []Transaction{}, "validatorAddress")
+			stateMutex.Lock()
+			oldBlock := Blockchain[len(Blockchain)-1]
+			stateMutex.Unlock()
+
+			newBlock, err := createBlock(oldBlock, takePendingTransactions(oldBlock.Index+1), "validatorAddress")
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			if isBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
-				candidateBlocks <- newBlock
+			// The node verifies its own block like a block received from a peer
+			verified, err := verifyBlock(newBlock, oldBlock)
+			if err != nil {
+				log.Println(err)
+			} else {
+				err = commitBlock(verified)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				prunePendingTransactions(verified)
+				candidateBlocks <- verified
 			}
 
 			io.WriteString(conn, fmt.Sprintf("\n%s", Blockchain))
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Guards balances while transactions execute concurrently
+var balancesMutex = &sync.RWMutex{}
+
+func getBalance(account string, denom string) Amount {
+	balancesMutex.RLock()
+	defer balancesMutex.RUnlock()
+
+	return balances[balanceKey{Account: account, Denom: denomOrNative(denom)}]
+}
+
+func addBalance(account string, denom string, amount Amount) error {
+	balancesMutex.Lock()
+	defer balancesMutex.Unlock()
+
+	key := balanceKey{Account: account, Denom: denomOrNative(denom)}
+	balance, err := balances[key].Add(amount)
+	if err != nil {
+		return err
+	}
+
+	journal.recordBalance(key)
+	balances[key] = balance
+	return nil
+}
+
+func subBalance(account string, denom string, amount Amount) error {
+	balancesMutex.Lock()
+	defer balancesMutex.Unlock()
+
+	key := balanceKey{Account: account, Denom: denomOrNative(denom)}
+	balance, err := balances[key].Sub(amount)
+	if err != nil {
+		return errors.New("insufficient balance")
+	}
+
+	journal.recordBalance(key)
+	if balance.IsZero() {
+		delete(balances, key)
+	} else {
+		balances[key] = balance
+	}
+	return nil
+}
+
+// verifySignatures checks the signatures of the transactions across all cores.
+// It reads no state, so it can run before the block is executed.
+func verifySignatures(txs []Transaction) []bool {
+	valid := make([]bool, len(txs))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				valid[i] = hasValidSignatures(txs[i])
+			}
+		}()
+	}
+
+	for i := range txs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return valid
+}
+
+// isPlainTransfer reports whether a transaction is a single transfer between known accounts.
+// Transfers check the balance before writing anything, so they never leave partial
+// changes behind and can run concurrently with transfers between other accounts.
+func isPlainTransfer(tx Transaction) bool {
+	return len(tx.Messages) == 0 && transactionType(tx) == "transfer" && tx.Granter == "" && !usesFeeAllowance(tx)
+}
+
+// accessSet returns the accounts a transaction reads or writes,
+// or false when they cannot be known without executing it
+func accessSet(tx Transaction) ([]string, bool) {
+	if !isPlainTransfer(tx) {
+		return nil, false
+	}
+
+	return []string{tx.From, tx.To, feePayer(tx)}, true
+}
+
+func conflicts(touched map[string]bool, accounts []string) bool {
+	for _, account := range accounts {
+		if touched[account] {
+			return true
+		}
+	}
+	return false
+}
+
+// executeTransactions executes the transactions of a block and returns their receipts.
+// Consecutive transactions are grouped into a batch as long as they touch disjoint
+// accounts. The transactions of a batch are checked against the state one after another,
+// then the ones that passed run concurrently. Batches run one after another and a
+// transaction with an unknown access set runs on its own, so the receipts and the
+// final state are the same as executing the transactions in order.
+//
+// Only plain transfers declare an access set, so they are the only transactions that
+// run concurrently. Every other type writes shared maps and runs on its own.
+func executeTransactions(txs []Transaction, height int, now int64) []Receipt {
+	receipts := make([]Receipt, len(txs))
+
+	for start := 0; start < len(txs); {
+		end := start + 1
+
+		if accounts, ok := accessSet(txs[start]); ok {
+			touched := make(map[string]bool)
+			for _, account := range accounts {
+				touched[account] = true
+			}
+
+			for end < len(txs) {
+				accounts, ok := accessSet(txs[end])
+				if !ok || conflicts(touched, accounts) {
+					break
+				}
+
+				for _, account := range accounts {
+					touched[account] = true
+				}
+				end++
+			}
+		}
+
+		if end-start == 1 {
+			receipts[start] = executeTransaction(txs[start], height, now)
+		} else {
+			// The checks read state, so they run before any transaction of the batch writes
+			for i := start; i < end; i++ {
+				receipts[i] = checkTransaction(txs[i], height, now)
+			}
+
+			var wg sync.WaitGroup
+			for i := start; i < end; i++ {
+				if receipts[i].Status == ReceiptInvalid {
+					continue
+				}
+
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					receipts[i] = runTransaction(txs[i], receipts[i], height, now)
+				}(i)
+			}
+			wg.Wait()
+		}
+
+		start = end
+	}
+
+	return receipts
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func plainTransfer(from string, to string, amount int64, nonce uint64) Transaction {
+	return Transaction{From: from, To: to, Amount: NewAmount(amount), Fee: NewAmount(1), Nonce: nonce}
+}
+
+// blockTransactions mixes independent transfers, transfers that depend on an earlier one,
+// a transfer that cannot be included, a replay and a transaction without an access set
+func blockTransactions() []Transaction {
+	return []Transaction{
+		plainTransfer("alice", "bob", 10, 0),
+		plainTransfer("carol", "dave", 20, 0),
+		plainTransfer("bob", "erin", 15, 0),  // Only covered by the transfer from alice
+		plainTransfer("frank", "gina", 5, 0), // Frank has no balance
+		{Type: "stake", From: "dave", Amount: NewAmount(10), Fee: NewAmount(1)},
+		plainTransfer("carol", "alice", 5, 1),
+		plainTransfer("carol", "alice", 5, 1), // Replays the nonce
+		plainTransfer("erin", "alice", 14, 0),
+	}
+}
+
+func fundAccounts() {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	addBalance("bob", NativeDenom, NewAmount(6))
+	addBalance("carol", NativeDenom, NewAmount(50))
+	addBalance("dave", NativeDenom, NewAmount(1))
+}
+
+func TestExecuteTransactionsMatchesSequentialExecution(t *testing.T) {
+	txs := blockTransactions()
+
+	fundAccounts()
+	var want []Receipt
+	for _, tx := range txs {
+		want = append(want, executeTransaction(tx, 1, 1000))
+	}
+	wantState := takeSnapshot()
+
+	fundAccounts()
+	got := executeTransactions(txs, 1, 1000)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("receipts = %+v, want %+v", got, want)
+	}
+	if !reflect.DeepEqual(takeSnapshot(), wantState) {
+		t.Error("state differs from executing the transactions in order")
+	}
+
+	statuses := []ReceiptStatus{ReceiptSuccess, ReceiptSuccess, ReceiptSuccess, ReceiptInvalid, ReceiptSuccess, ReceiptSuccess, ReceiptInvalid, ReceiptSuccess}
+	for i, status := range statuses {
+		if got[i].Status != status {
+			t.Errorf("receipt %d status = %v, want %v (%s)", i, got[i].Status, status, got[i].Error)
+		}
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(108)) != 0 {
+		t.Errorf("alice balance = %s, want 108", balance)
+	}
+	if stake := validators["dave"]; stake.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("dave stake = %s, want 10", stake)
+	}
+}
+
+func TestAccessSet(t *testing.T) {
+	if accounts, ok := accessSet(plainTransfer("alice", "bob", 1, 0)); !ok || !reflect.DeepEqual(accounts, []string{"alice", "bob", "alice"}) {
+		t.Errorf("accessSet() = %v, %v, want the sender and the recipient", accounts, ok)
+	}
+
+	sponsored := plainTransfer("alice", "bob", 1, 0)
+	sponsored.FeePayer, sponsored.FeePayerSignature = "carol", "signed"
+	if accounts, ok := accessSet(sponsored); !ok || !reflect.DeepEqual(accounts, []string{"alice", "bob", "carol"}) {
+		t.Errorf("accessSet() = %v, %v, want the fee payer included", accounts, ok)
+	}
+
+	granted := plainTransfer("alice", "bob", 1, 0)
+	granted.FeePayer = "carol"
+	onBehalf := plainTransfer("alice", "bob", 1, 0)
+	onBehalf.Granter = "carol"
+	multi := Transaction{From: "alice", Messages: []Message{{Type: "transfer", To: "bob", Amount: NewAmount(1)}}}
+
+	for _, tx := range []Transaction{granted, onBehalf, multi, {Type: "stake", From: "alice"}} {
+		if _, ok := accessSet(tx); ok {
+			t.Errorf("accessSet(%+v) is known, want it unknown", tx)
+		}
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	resetState()
+	alice, bob := NewWallet(), NewWallet()
+
+	tampered := bob.CreateTransaction("carol", NewAmount(1))
+	tampered.Amount = NewAmount(2)
+
+	txs := []Transaction{
+		alice.CreateTransaction("carol", NewAmount(1)),
+		tampered,
+		bob.CreateTransaction("carol", NewAmount(1)),
+	}
+	if valid := verifySignatures(txs); !reflect.DeepEqual(valid, []bool{true, false, true}) {
+		t.Errorf("verifySignatures() = %v, want [true false true]", valid)
+	}
+}
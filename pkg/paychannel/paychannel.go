@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// A PaymentChannel locks a deposit from the sender so it can pay the recipient
+// off-chain with signed balance updates. Only opening and closing the channel
+// touch the chain. A close started by the sender waits for a challenge period
+// in which the recipient can dispute it with a newer balance update.
+type PaymentChannel struct {
+	ID              string // operationID of the open transaction and message
+	Sender          string
+	Recipient       string
+	Deposit         Amount
+	Denom           string
+	Paid            Amount // Cumulative amount of the latest balance update submitted on-chain
+	ChallengePeriod int    // Number of blocks a close started by the sender can be disputed for
+	ClosingHeight   int    // Block height from which the channel can be settled, 0 while it is open
+}
+
+// A BalanceUpdate is signed by the sender and passed to the recipient off-chain.
+// Each update replaces the previous one, so it carries the cumulative amount paid.
+// Payments only grow, so the update with the larger amount is always the newer one.
+type BalanceUpdate struct {
+	ChannelID string
+	Amount    Amount // Total owed to the recipient
+	Signature string // Signature of the sender
+}
+
+var paymentChannels = make(map[string]PaymentChannel)
+
+func GetPaymentChannel(id string) (PaymentChannel, error) {
+	channel, ok := paymentChannels[id]
+	if !ok {
+		return PaymentChannel{}, fmt.Errorf("payment channel not found: %s", id)
+	}
+	return channel, nil
+}
+
+// balanceUpdateHash returns the digest the sender signs for a balance update
+func balanceUpdateHash(update BalanceUpdate) []byte {
+	update.Signature = ""
+
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return nil
+	}
+
+	hashed := sha256.Sum256(payload)
+	return hashed[:]
+}
+
+func (c PaymentChannel) checkBalanceUpdate(update BalanceUpdate) error {
+	if update.ChannelID != c.ID {
+		return errors.New("balance update is for another channel")
+	}
+
+	if c.Deposit.LT(update.Amount) {
+		return errors.New("balance update exceeds the channel deposit")
+	}
+
+	// An older update would take back payments the recipient is already owed
+	if update.Amount.LT(c.Paid) {
+		return errors.New("balance update lowers the amount paid")
+	}
+
+	pubKey := convertPublicKey(c.Sender)
+	hashed := balanceUpdateHash(update)
+	if pubKey == nil || hashed == nil || !verifySignature(pubKey, hashed, update.Signature) {
+		return errors.New("invalid balance update signature")
+	}
+
+	return nil
+}
+
+// channelUpdate reads the channel and the optional balance update of a channel transaction
+func channelUpdate(tx Transaction) (PaymentChannel, *BalanceUpdate, error) {
+	id, _ := tx.Data["channel"].(string)
+	channel, err := GetPaymentChannel(id)
+	if err != nil {
+		return channel, nil, err
+	}
+
+	if _, ok := tx.Data["update"]; !ok {
+		return channel, nil, nil
+	}
+
+	var update BalanceUpdate
+	err = dataValue(tx.Data, "update", &update)
+	if err != nil {
+		return channel, nil, errors.New("invalid balance update")
+	}
+
+	err = channel.checkBalanceUpdate(update)
+	if err != nil {
+		return channel, nil, err
+	}
+
+	return channel, &update, nil
+}
+
+func OpenChannelTransaction(tx Transaction) error {
+	if tx.To == "" || tx.To == tx.From {
+		return errors.New("invalid recipient")
+	}
+
+	if tx.Amount.IsZero() {
+		return errors.New("invalid deposit")
+	}
+
+	challengePeriod, ok := dataInt(tx.Data, "challengePeriod")
+	if !ok {
+		challengePeriod = int64(GlobalConfig["channelChallengePeriod"])
+	}
+	if challengePeriod <= 0 {
+		return errors.New("invalid challenge period")
+	}
+
+	id := executionID(tx)
+	if _, ok := paymentChannels[id]; ok {
+		return fmt.Errorf("payment channel already exists: %s", id)
+	}
+
+	// Lock the deposit until the channel is settled
+	err := spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	channel := PaymentChannel{
+		ID:              id,
+		Sender:          tx.From,
+		Recipient:       tx.To,
+		Deposit:         tx.Amount,
+		Denom:           denomOrNative(tx.Denom),
+		ChallengePeriod: int(challengePeriod),
+	}
+	journal.recordPaymentChannel(channel.ID)
+	paymentChannels[channel.ID] = channel
+
+	emitEvent(tx, "paychan_open", map[string]string{
+		"id":        channel.ID,
+		"sender":    channel.Sender,
+		"recipient": channel.Recipient,
+		"deposit":   channel.Deposit.String(),
+		"denom":     channel.Denom,
+	})
+
+	return nil
+}
+
+// CloseChannelTransaction closes a channel with the latest balance update.
+// The recipient can only lower its own payout, so a close by the recipient settles
+// the channel at once. A close by the sender starts the challenge period.
+func CloseChannelTransaction(tx Transaction) error {
+	channel, update, err := channelUpdate(tx)
+	if err != nil {
+		return err
+	}
+
+	if channel.ClosingHeight != 0 {
+		return errors.New("payment channel is already closing")
+	}
+
+	if update != nil {
+		channel.Paid = update.Amount
+	}
+
+	switch tx.From {
+	case channel.Recipient:
+		return settleChannel(tx, channel)
+	case channel.Sender:
+		channel.ClosingHeight = tx.blockHeight + channel.ChallengePeriod
+		journal.recordPaymentChannel(channel.ID)
+		paymentChannels[channel.ID] = channel
+	default:
+		return errors.New("only the sender or the recipient can close a payment channel")
+	}
+
+	emitEvent(tx, "paychan_close", map[string]string{
+		"id":            channel.ID,
+		"paid":          channel.Paid.String(),
+		"closingHeight": strconv.Itoa(channel.ClosingHeight),
+	})
+
+	return nil
+}
+
+// DisputeChannelTransaction replaces the balance update of a closing channel with one paying more
+func DisputeChannelTransaction(tx Transaction) error {
+	channel, update, err := channelUpdate(tx)
+	if err != nil {
+		return err
+	}
+
+	if channel.ClosingHeight == 0 {
+		return errors.New("payment channel is not closing")
+	}
+
+	if tx.blockHeight >= channel.ClosingHeight {
+		return errors.New("challenge period is over")
+	}
+
+	if update == nil || update.Amount.Cmp(channel.Paid) == 0 {
+		return errors.New("dispute needs a balance update paying more")
+	}
+
+	channel.Paid = update.Amount
+	journal.recordPaymentChannel(channel.ID)
+	paymentChannels[channel.ID] = channel
+
+	emitEvent(tx, "paychan_dispute", map[string]string{
+		"id":   channel.ID,
+		"paid": channel.Paid.String(),
+	})
+
+	return nil
+}
+
+// SettleChannelTransaction pays out a channel once its challenge period is over
+func SettleChannelTransaction(tx Transaction) error {
+	id, _ := tx.Data["channel"].(string)
+	channel, err := GetPaymentChannel(id)
+	if err != nil {
+		return err
+	}
+
+	if channel.ClosingHeight == 0 || tx.blockHeight < channel.ClosingHeight {
+		return errors.New("challenge period is not over")
+	}
+
+	return settleChannel(tx, channel)
+}
+
+// settleChannel pays the recipient the amount owed and refunds the rest of the deposit
+func settleChannel(tx Transaction, channel PaymentChannel) error {
+	refund, err := channel.Deposit.Sub(channel.Paid)
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(channel.Recipient, channel.Denom, channel.Paid)
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(channel.Sender, channel.Denom, refund)
+	if err != nil {
+		return err
+	}
+	journal.recordPaymentChannel(channel.ID)
+	delete(paymentChannels, channel.ID)
+
+	emitEvent(tx, "paychan_settle", map[string]string{
+		"id":     channel.ID,
+		"paid":   channel.Paid.String(),
+		"refund": refund.String(),
+	})
+
+	return nil
+}
+
+// ChannelPayer keeps the sender's side of a payment channel and signs its balance updates
+type ChannelPayer struct {
+	wallet    *Wallet
+	ChannelID string
+	Recipient string
+	Deposit   Amount
+	Latest    BalanceUpdate
+}
+
+// OpenPaymentChannel creates the transaction opening a channel to the recipient
+// and the payer that tracks it. A challenge period of 0 uses the chain default. The channel is usable once the transaction is in a block.
+func (w *Wallet) OpenPaymentChannel(recipient string, deposit Amount, challengePeriod int) (Transaction, *ChannelPayer) {
+	data := make(map[string]interface{})
+	if challengePeriod > 0 {
+		data["challengePeriod"] = challengePeriod
+	}
+
+	from := publicKeyToString(w.PublicKey)
+	tx := Transaction{
+		Type:         "paychan_open",
+		From:         from,
+		To:           recipient,
+		Amount:       deposit,
+		Data:         data,
+		Nonce:        nextNonce(from),
+		ExpiryHeight: defaultExpiryHeight(),
+	}
+
+	tx.Signature = w.signTransaction(tx)
+
+	// The channel gets the ID of the open transaction, which carries no other message
+	id := operationID(TransactionHash(tx), 0)
+	payer := &ChannelPayer{
+		wallet:    w,
+		ChannelID: id,
+		Recipient: recipient,
+		Deposit:   deposit,
+		Latest:    BalanceUpdate{ChannelID: id},
+	}
+
+	return tx, payer
+}
+
+// Pay signs a balance update that adds the amount to what the recipient is owed
+func (p *ChannelPayer) Pay(amount Amount) (BalanceUpdate, error) {
+	total, err := p.Latest.Amount.Add(amount)
+	if err != nil {
+		return BalanceUpdate{}, err
+	}
+
+	if p.Deposit.LT(total) {
+		return BalanceUpdate{}, errors.New("payment exceeds the channel deposit")
+	}
+
+	update := BalanceUpdate{ChannelID: p.ChannelID, Amount: total}
+	update.Signature, err = p.wallet.signBalanceUpdate(update)
+	if err != nil {
+		return BalanceUpdate{}, err
+	}
+
+	p.Latest = update
+	return update, nil
+}
+
+// CloseTransaction starts closing the channel with the latest update the payer signed
+func (p *ChannelPayer) CloseTransaction() Transaction {
+	return p.wallet.channelTransaction("paychan_close", p.ChannelID, &p.Latest)
+}
+
+// ChannelPayee keeps the recipient's side of a payment channel and checks the updates it receives
+type ChannelPayee struct {
+	Channel PaymentChannel
+	Latest  *BalanceUpdate
+}
+
+func NewChannelPayee(channelID string) (*ChannelPayee, error) {
+	channel, err := GetPaymentChannel(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChannelPayee{Channel: channel}, nil
+}
+
+// Receive checks a balance update and returns the amount it adds to the previous one
+func (p *ChannelPayee) Receive(update BalanceUpdate) (Amount, error) {
+	err := p.Channel.checkBalanceUpdate(update)
+	if err != nil {
+		return Amount{}, err
+	}
+
+	var previous Amount
+	if p.Latest != nil {
+		previous = p.Latest.Amount
+	}
+
+	received, err := update.Amount.Sub(previous)
+	if err != nil || received.IsZero() {
+		return Amount{}, errors.New("stale balance update")
+	}
+
+	p.Latest = &update
+	return received, nil
+}
+
+// CloseTransaction closes and settles the channel with the latest update received
+func (p *ChannelPayee) CloseTransaction(w *Wallet) Transaction {
+	return w.channelTransaction("paychan_close", p.Channel.ID, p.Latest)
+}
+
+// DisputeTransaction answers a close by the sender with the latest update received
+func (p *ChannelPayee) DisputeTransaction(w *Wallet) Transaction {
+	return w.channelTransaction("paychan_dispute", p.Channel.ID, p.Latest)
+}
+
+func (w *Wallet) channelTransaction(txType string, channelID string, update *BalanceUpdate) Transaction {
+	data := map[string]interface{}{"channel": channelID}
+	if update != nil && update.Signature != "" {
+		data["update"] = *update
+	}
+
+	from := publicKeyToString(w.PublicKey)
+	tx := Transaction{
+		Type:         txType,
+		From:         from,
+		Data:         data,
+		Nonce:        nextNonce(from),
+		ExpiryHeight: defaultExpiryHeight(),
+	}
+
+	tx.Signature = w.signTransaction(tx)
+
+	return tx
+}
+
+func (w *Wallet) signBalanceUpdate(update BalanceUpdate) (string, error) {
+	hashed := balanceUpdateHash(update)
+	if hashed == nil {
+		return "", errors.New("could not hash balance update")
+	}
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, w.PrivateKey, crypto.SHA256, hashed)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(signature), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import "testing"
+
+func TestCheckBalanceUpdate(t *testing.T) {
+	sender := NewWallet()
+	channel := PaymentChannel{
+		ID:      "channel",
+		Sender:  publicKeyToString(sender.PublicKey),
+		Deposit: NewAmount(100),
+		Paid:    NewAmount(50),
+	}
+
+	signed := func(channelID string, amount int64) BalanceUpdate {
+		update := BalanceUpdate{ChannelID: channelID, Amount: NewAmount(amount)}
+		update.Signature, _ = sender.signBalanceUpdate(update)
+		return update
+	}
+
+	forged := signed("channel", 60)
+	forged.Amount = NewAmount(70)
+
+	tests := []struct {
+		name   string
+		update BalanceUpdate
+		valid  bool
+	}{
+		{"higher amount", signed("channel", 60), true},
+		{"same amount", signed("channel", 50), true},
+		{"whole deposit", signed("channel", 100), true},
+		{"lower amount", signed("channel", 40), false},
+		{"above deposit", signed("channel", 101), false},
+		{"other channel", signed("other", 60), false},
+		{"forged amount", forged, false},
+	}
+
+	for _, tt := range tests {
+		err := channel.checkBalanceUpdate(tt.update)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: checkBalanceUpdate() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestChannelPayeeReceive(t *testing.T) {
+	sender := NewWallet()
+	payer := &ChannelPayer{wallet: sender, ChannelID: "channel", Deposit: NewAmount(100)}
+	payee := &ChannelPayee{Channel: PaymentChannel{
+		ID:      "channel",
+		Sender:  publicKeyToString(sender.PublicKey),
+		Deposit: NewAmount(100),
+	}}
+
+	first, _ := payer.Pay(NewAmount(30))
+	second, _ := payer.Pay(NewAmount(20))
+
+	tests := []struct {
+		name     string
+		update   BalanceUpdate
+		received int64
+		valid    bool
+	}{
+		{"first payment", first, 30, true},
+		{"second payment", second, 20, true},
+		{"replayed payment", second, 0, false},
+		{"older payment", first, 0, false},
+	}
+
+	for _, tt := range tests {
+		received, err := payee.Receive(tt.update)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: Receive() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if tt.valid && received.Cmp(NewAmount(tt.received)) != 0 {
+			t.Errorf("%s: Receive() = %s, want %d", tt.name, received, tt.received)
+		}
+	}
+}
+
+func TestChannelDisputeAndSettle(t *testing.T) {
+	resetState()
+	sender := NewWallet()
+	from := publicKeyToString(sender.PublicKey)
+	addBalance(from, NativeDenom, NewAmount(150))
+
+	open := Transaction{Type: "paychan_open", From: from, To: "bob", Amount: NewAmount(100), Data: map[string]interface{}{"challengePeriod": 10}, blockHeight: 1}
+	if err := OpenChannelTransaction(open); err != nil {
+		t.Fatalf("OpenChannelTransaction() error = %v", err)
+	}
+	id := executionID(open)
+	if balance := getBalance(from, NativeDenom); balance.Cmp(NewAmount(50)) != 0 {
+		t.Errorf("sender balance = %s, want the deposit locked", balance)
+	}
+
+	payer := &ChannelPayer{wallet: sender, ChannelID: id, Deposit: NewAmount(100)}
+	older, _ := payer.Pay(NewAmount(30))
+	newer, _ := payer.Pay(NewAmount(30))
+
+	channelTx := func(txType string, from string, height int, update *BalanceUpdate) Transaction {
+		data := map[string]interface{}{"channel": id}
+		if update != nil {
+			data["update"] = *update
+		}
+		return Transaction{Type: txType, From: from, Data: data, blockHeight: height}
+	}
+
+	// The sender closes with an older update, the recipient disputes it in time
+	if err := CloseChannelTransaction(channelTx("paychan_close", from, 5, &older)); err != nil {
+		t.Fatalf("CloseChannelTransaction() error = %v", err)
+	}
+	if channel, _ := GetPaymentChannel(id); channel.ClosingHeight != 15 || channel.Paid.Cmp(NewAmount(30)) != 0 {
+		t.Fatalf("closing channel = %+v, want it closing at 15 with 30 paid", channel)
+	}
+	if err := SettleChannelTransaction(channelTx("paychan_settle", "bob", 14, nil)); err == nil {
+		t.Error("settle during the challenge period error = nil")
+	}
+	if err := DisputeChannelTransaction(channelTx("paychan_dispute", "bob", 14, &older)); err == nil {
+		t.Error("dispute with the same update error = nil")
+	}
+	if err := DisputeChannelTransaction(channelTx("paychan_dispute", "bob", 14, &newer)); err != nil {
+		t.Fatalf("DisputeChannelTransaction() error = %v", err)
+	}
+	if err := DisputeChannelTransaction(channelTx("paychan_dispute", "bob", 15, &newer)); err == nil {
+		t.Error("dispute after the challenge period error = nil")
+	}
+
+	if err := SettleChannelTransaction(channelTx("paychan_settle", "carol", 15, nil)); err != nil {
+		t.Fatalf("SettleChannelTransaction() error = %v", err)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(60)) != 0 {
+		t.Errorf("recipient balance = %s, want 60", balance)
+	}
+	if balance := getBalance(from, NativeDenom); balance.Cmp(NewAmount(90)) != 0 {
+		t.Errorf("sender balance = %s, want 90 with the refund", balance)
+	}
+	if _, err := GetPaymentChannel(id); err == nil {
+		t.Error("settled channel was kept")
+	}
+}
+
+func TestRecipientCloseSettlesAtOnce(t *testing.T) {
+	resetState()
+	sender := NewWallet()
+	from := publicKeyToString(sender.PublicKey)
+	paymentChannels["channel"] = PaymentChannel{ID: "channel", Sender: from, Recipient: "bob", Deposit: NewAmount(100), Denom: NativeDenom, ChallengePeriod: 10}
+
+	payer := &ChannelPayer{wallet: sender, ChannelID: "channel", Deposit: NewAmount(100)}
+	update, _ := payer.Pay(NewAmount(40))
+
+	tx := Transaction{Type: "paychan_close", From: "bob", Data: map[string]interface{}{"channel": "channel", "update": update}, blockHeight: 5}
+	if err := CloseChannelTransaction(tx); err != nil {
+		t.Fatalf("CloseChannelTransaction() error = %v", err)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(40)) != 0 {
+		t.Errorf("recipient balance = %s, want 40", balance)
+	}
+	if balance := getBalance(from, NativeDenom); balance.Cmp(NewAmount(60)) != 0 {
+		t.Errorf("sender refund = %s, want 60", balance)
+	}
+	if len(paymentChannels) != 0 {
+		t.Errorf("channels = %v, want none", paymentChannels)
+	}
+}
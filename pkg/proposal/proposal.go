@@ -58,6 +58,7 @@ func Vote(node Node, proposalID string, vote bool) error {
 				return errors.New("node has already voted on this proposal")
 			}
 
+			journal.recordVote(i, node.Address)
 			Proposals[i].Votes[node.Address] = vote
 			return nil
 		}
@@ -135,45 +136,46 @@ func executeProposalApplicationLogic(ctx sdk.Context, k keeper.Keeper, proposal
 }
 
 func handleTokenTransferProposal(ctx sdk.Context, k keeper.Keeper, data ProposalData, proposal Proposal) error {
-	// Extract the sender, receiver and amount from the proposal data
+	// Extract the sender, receiver, amount and denomination from the proposal data
 	sender := data.Sender
 	receiver := data.Receiver
 	amount := data.Amount
+	denom := denomOrNative(data.Denom)
 
 	// Deduct the tokens from the sender's account
-	balances[sender] -= amount
+	err := subBalance(sender, denom, amount)
+	if err != nil {
+		return err
+	}
 
 	// Add the tokens to the receiver's account
-	balances[receiver] += amount
-
-	return nil
+	return addBalance(receiver, denom, amount)
 }
 
 func handleSmartContractExecutionProposal(ctx sdk.Context, k keeper.Keeper, data ProposalData, proposal Proposal) error {
-	// Extract the contract and parameters from the proposal data
-	contract := data.Contract
-	parameters := data.Parameters
-
-	// Create a new instance of the smart contract
-	sc := SmartContract{
-		Code: contract,
-		Data: parameters,
-	}
-
-	// Execute the smart contract
-	vm, err := exec.NewVirtualMachine(sc.Code, exec.VMConfig{}, nil, nil)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	_, err = vm.Run(sc.Code)
-	if err != nil {
-		log.Println(err)
-		return err
+	// Extract the new code and the contract to migrate from the proposal data
+	address, _ := data.Parameters["address"].(string)
+	function, _ := data.Parameters["function"].(string)
+
+	// A passed proposal migrates a contract administered by governance
+	tx := Transaction{
+		Type: "contract_migrate",
+		From: GovernanceAddress,
+		Contract: &SmartContract{
+			Code:     data.Contract,
+			Data:     data.Parameters,
+			Address:  address,
+			Function: function,
+		},
+		Data:        data.Parameters,
+		GasLimit:    GlobalConfig["maxGasLimit"],
+		blockHeight: int(ctx.BlockHeight()),
+		blockTime:   ctx.BlockTime().Unix(),
 	}
 
-	return nil
+	return journaled(false, func() error {
+		return MigrateContractTransaction(tx)
+	})
 }
 
 func handleProtocolChangeProposal(ctx sdk.Context, k keeper.Keeper, data ProposalData, proposal Proposal) error {
@@ -247,7 +249,7 @@ func CustomTransaction(tx Transaction) error {
 	}
 
 	// Extract the amount from the transaction data
-	amount, ok := tx.Data["amount"].(int)
+	amount, ok := dataAmount(tx.Data, "amount")
 	if !ok {
 		return errors.New("invalid amount")
 	}
@@ -255,18 +257,29 @@ func CustomTransaction(tx Transaction) error {
 	// Handle the operation
 	switch operation {
 	case "mint":
+		// Only a passed governance proposal can create native coin
+		if tx.From != GovernanceAddress {
+			return errors.New("only governance can mint")
+		}
+
 		// Mint tokens to the sender's account
-		balances[tx.From] += amount
-		fmt.Printf("Minted %d tokens to %s\n", amount, tx.From)
+		err := addBalance(tx.From, NativeDenom, amount)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Minted %s tokens to %s\n", amount, tx.From)
 	case "burn":
 		// Check if the sender has enough balance to burn
-		if balances[tx.From] < amount {
+		if spendableBalance(tx.From, NativeDenom, tx.blockTime).LT(amount) {
 			return errors.New("insufficient balance to burn")
 		}
 
 		// Burn tokens from the sender's account
-		balances[tx.From] -= amount
-		fmt.Printf("Burned %d tokens from %s\n", amount, tx.From)
+		err := subBalance(tx.From, NativeDenom, amount)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Burned %s tokens from %s\n", amount, tx.From)
 	default:
 		return fmt.Errorf("unknown operation: %s", operation)
 	}
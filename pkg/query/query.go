@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A stateDiff holds the entries a block overwrote in the state contracts read: balances,
+// contract storage and contract instances. Reverting the diffs of the latest blocks in
+// the live state, newest first, gives the state at an earlier height.
+type stateDiff struct {
+	balances  map[balanceKey]Amount        // Balances before the block, zero for none
+	storage   map[string]map[string][]byte // Storage entries before the block, nil for none
+	contracts map[string]*ContractInstance // Instances before the block, nil for none
+}
+
+// Maps block heights to the changes of the block, for queries against past state
+var stateHistory = make(map[int]stateDiff)
+
+// A ContractQuery calls a contract function without a transaction. Queries read a copy of
+// the state and cannot change it, a storage write or transfer stops the query with an error.
+type ContractQuery struct {
+	Height   int // Block height whose state the query runs against, 0 for the latest state
+	Caller   string
+	Address  string
+	Function string
+	Args     []int64
+	Data     map[string]interface{}
+	GasLimit int // 0 for the chain's maximum gas limit, which also caps it
+}
+
+type QueryResult struct {
+	Result  int64
+	Events  []Event
+	GasUsed int
+	Error   string // Why the call failed, empty on success
+}
+
+// recordState keeps what a block changes in the live state before the state after it is
+// installed, and forgets the changes that have fallen out of the stateHistory window
+func recordState(height int, state stateSnapshot) {
+	stateHistory[height] = diffState(state)
+	delete(stateHistory, height-GlobalConfig["stateHistory"])
+}
+
+// diffState returns the entries of the live state that differ in the given state
+func diffState(state stateSnapshot) stateDiff {
+	diff := stateDiff{
+		balances:  make(map[balanceKey]Amount),
+		storage:   make(map[string]map[string][]byte),
+		contracts: make(map[string]*ContractInstance),
+	}
+
+	for key, amount := range balances {
+		if state.balances[key].Cmp(amount) != 0 {
+			diff.balances[key] = amount
+		}
+	}
+	for key := range state.balances {
+		if _, ok := balances[key]; !ok {
+			diff.balances[key] = Amount{}
+		}
+	}
+
+	record := func(address string, key string, value []byte) {
+		if diff.storage[address] == nil {
+			diff.storage[address] = make(map[string][]byte)
+		}
+		diff.storage[address][key] = value
+	}
+	for address, entries := range contractStorage {
+		for key, value := range entries {
+			if after, ok := state.storage[address][key]; !ok || !bytes.Equal(after, value) {
+				record(address, key, append([]byte{}, value...))
+			}
+		}
+	}
+	for address, entries := range state.storage {
+		for key := range entries {
+			if _, ok := contractStorage[address][key]; !ok {
+				record(address, key, nil)
+			}
+		}
+	}
+
+	for address, instance := range contracts {
+		if after, ok := state.contracts[address]; !ok || after != instance {
+			instance := instance
+			diff.contracts[address] = &instance
+		}
+	}
+	for address := range state.contracts {
+		if _, ok := contracts[address]; !ok {
+			diff.contracts[address] = nil
+		}
+	}
+
+	return diff
+}
+
+// A queryState is a copy of the state contracts read. Queries run against it without
+// holding stateMutex, so a long query does not hold up block production.
+type queryState struct {
+	balances  map[balanceKey]Amount
+	storage   map[string]map[string][]byte
+	contracts map[string]ContractInstance
+	code      map[string][]byte
+}
+
+// errReadOnlyQuery stops a query that tries to change state
+var errReadOnlyQuery = errors.New("contract queries cannot change state")
+
+func copyQueryState() *queryState {
+	return &queryState{
+		balances:  copyBalances(balances),
+		storage:   copyContractStorage(contractStorage),
+		contracts: copyContracts(contracts),
+		code:      copyContractCode(contractCode),
+	}
+}
+
+// revert undoes the changes of a block in the copy
+func (s *queryState) revert(diff stateDiff) {
+	for key, amount := range diff.balances {
+		if amount.IsZero() {
+			delete(s.balances, key)
+		} else {
+			s.balances[key] = amount
+		}
+	}
+
+	for address, entries := range diff.storage {
+		for key, value := range entries {
+			if value == nil {
+				delete(s.storage[address], key)
+				continue
+			}
+
+			if s.storage[address] == nil {
+				s.storage[address] = make(map[string][]byte)
+			}
+			s.storage[address][key] = value
+		}
+	}
+
+	for address, instance := range diff.contracts {
+		if instance == nil {
+			delete(s.contracts, address)
+		} else {
+			s.contracts[address] = *instance
+		}
+	}
+}
+
+// The read methods of a contractEnv read the copy a query runs against, or the live state
+
+func (env *contractEnv) readStorage(key string) ([]byte, bool) {
+	if env.view != nil {
+		value, ok := env.view.storage[env.address][key]
+		return value, ok
+	}
+	value, ok := contractStorage[env.address][key]
+	return value, ok
+}
+
+func (env *contractEnv) readBalance(account string, denom string) Amount {
+	if env.view != nil {
+		return env.view.balances[balanceKey{Account: account, Denom: denomOrNative(denom)}]
+	}
+	return getBalance(account, denom)
+}
+
+func (env *contractEnv) readContract(address string) (ContractInstance, error) {
+	if env.view != nil {
+		instance, ok := env.view.contracts[address]
+		if !ok {
+			return ContractInstance{}, fmt.Errorf("contract not found: %s", address)
+		}
+		return instance, nil
+	}
+	return GetContract(address)
+}
+
+func (env *contractEnv) readCode(hash string) []byte {
+	if env.view != nil {
+		return env.view.code[hash]
+	}
+	return contractCode[hash]
+}
+
+// checkWritable stops a query that tries to change state
+func (env *contractEnv) checkWritable() {
+	if env.view != nil {
+		panic(errReadOnlyQuery)
+	}
+}
+
+// queryGasLimit bounds the gas of a query by maxQueryGas, which is well below the gas limit
+// of a transaction as nobody pays for queries. 0 asks for the maximum.
+func queryGasLimit(gasLimit int) int {
+	if gasLimit == 0 || gasLimit > GlobalConfig["maxQueryGas"] {
+		return GlobalConfig["maxQueryGas"]
+	}
+	return gasLimit
+}
+
+// QueryContract runs a contract function against the state at the query height
+func QueryContract(query ContractQuery) (QueryResult, error) {
+	stateMutex.Lock()
+	height := currentHeight()
+	if query.Height > height || query.Height < 0 {
+		stateMutex.Unlock()
+		return QueryResult{}, fmt.Errorf("state at height %d is not available", query.Height)
+	}
+
+	// Every block after the query height must still have its changes recorded
+	if query.Height != 0 {
+		for h := height; h > query.Height; h-- {
+			if _, ok := stateHistory[h]; !ok {
+				stateMutex.Unlock()
+				return QueryResult{}, fmt.Errorf("state at height %d is not available", query.Height)
+			}
+		}
+	}
+
+	// Only the copy is taken under the lock, the state at the query height is rebuilt in it
+	view := copyQueryState()
+	var diffs []stateDiff
+	if query.Height != 0 {
+		for h := height; h > query.Height; h-- {
+			diffs = append(diffs, stateHistory[h])
+		}
+		height = query.Height
+	}
+	now := queryTime(height)
+	stateMutex.Unlock()
+
+	for _, diff := range diffs {
+		view.revert(diff)
+	}
+
+	instance, ok := view.contracts[query.Address]
+	if !ok {
+		return QueryResult{}, fmt.Errorf("contract not found: %s", query.Address)
+	}
+
+	input, err := json.Marshal(query.Data)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	gasLimit := queryGasLimit(query.GasLimit)
+
+	// The query runs as if it was executed in the block after the one it reads, at the time of that block
+	var receipt Receipt
+	tx := Transaction{From: query.Caller, receipt: &receipt, blockHeight: height + 1, blockTime: now}
+	env := newContractEnv(tx, query.Caller, instance.Address, gasLimit)
+	env.input = input
+	env.view = view
+
+	function := query.Function
+	if function == "" {
+		function = "main"
+	}
+
+	result := QueryResult{}
+	result.Result, err = runContract(env, view.code[instance.CodeHash], function, query.Args...)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Events = receipt.Events
+	result.GasUsed = receipt.GasUsed
+
+	return result, nil
+}
+
+// queryTime is the timestamp of the block at the given height, which must be in the chain
+func queryTime(height int) int64 {
+	if len(Blockchain) == 0 {
+		return 0
+	}
+
+	now, _ := blockTime(Blockchain[len(Blockchain)-1-(currentHeight()-height)])
+	return now
+}
+
+// SimulateTransaction executes a transaction against the latest state and discards its effects.
+// Signatures are not checked, so wallets can estimate the gas of a transaction before signing it.
+// A transaction without a gas limit, or with one above maxQueryGas, is simulated with
+// maxQueryGas. Simulation runs the handlers of the live state, so it holds stateMutex, and
+// the low gas limit bounds how long it does. Its changes are undone through the journal.
+func SimulateTransaction(tx Transaction) Receipt {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	tx.GasLimit = queryGasLimit(tx.GasLimit)
+
+	var receipt Receipt
+	journaled(true, func() error {
+		receipt = executeTransaction(tx, currentHeight()+1, time.Now().Unix())
+		return nil
+	})
+	return receipt
+}
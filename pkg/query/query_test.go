@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// commitTestBlock appends a block whose execution is the given change of the state,
+// recording the change for queries like commitBlock does
+func commitTestBlock(change func()) {
+	snapshot := takeSnapshot()
+	change()
+	state := takeSnapshot()
+	restoreSnapshot(snapshot)
+
+	parent := Blockchain[len(Blockchain)-1]
+	block := blockAt(parent.Index+1, 1000+int64(parent.Index+1)*10)
+	recordState(block.Index, state)
+	restoreSnapshot(state)
+	Blockchain = append(Blockchain, block)
+}
+
+// queryTestChain funds alice in block 1, deploys the host ABI contract in block 2 with a
+// five byte value, and stores a ten byte value in block 3
+func queryTestChain() {
+	resetState()
+	stateHistory = make(map[int]stateDiff)
+	Blockchain = []Block{blockAt(0, 1000)}
+
+	commitTestBlock(func() {
+		addBalance("alice", NativeDenom, NewAmount(100))
+	})
+	commitTestBlock(func() {
+		deployTestContract("contract:abi", hostABIContract())
+		contractStorage["contract:abi"] = map[string][]byte{"key": []byte("value")}
+		addBalance("contract:abi", NativeDenom, NewAmount(100))
+	})
+	commitTestBlock(func() {
+		contractStorage["contract:abi"]["key"] = []byte("valuevalue")
+		subBalance("contract:abi", NativeDenom, NewAmount(40))
+	})
+}
+
+func TestQueryContractHistory(t *testing.T) {
+	queryTestChain()
+
+	tests := []struct {
+		name     string
+		height   int
+		function string
+		want     int64
+	}{
+		{"latest state", 0, "load", 10},
+		{"head", 3, "load", 10},
+		{"past state", 2, "load", 5},
+		{"runs in the block after the one it reads", 2, "height", 3},
+	}
+
+	for _, tt := range tests {
+		result, err := QueryContract(ContractQuery{Height: tt.height, Address: "contract:abi", Function: tt.function})
+		if err != nil || result.Error != "" {
+			t.Errorf("%s: QueryContract() error = %v, %s", tt.name, err, result.Error)
+			continue
+		}
+		if result.Result != tt.want {
+			t.Errorf("%s: result = %d, want %d", tt.name, result.Result, tt.want)
+		}
+	}
+
+	// The past state is rebuilt in a copy, the live state is left as it is
+	if value, _ := ContractStorage("contract:abi", "key"); string(value) != "valuevalue" {
+		t.Errorf("live storage = %q after a past query", value)
+	}
+	if balance := getBalance("contract:abi", NativeDenom); balance.Cmp(NewAmount(60)) != 0 {
+		t.Errorf("live balance = %s after a past query, want 60", balance)
+	}
+
+	if _, err := QueryContract(ContractQuery{Height: 1, Address: "contract:abi", Function: "load"}); err == nil {
+		t.Error("query before the contract was deployed error = nil")
+	}
+	for _, height := range []int{-1, 4} {
+		if _, err := QueryContract(ContractQuery{Height: height, Address: "contract:abi", Function: "load"}); err == nil {
+			t.Errorf("query at height %d error = nil", height)
+		}
+	}
+
+	// Once the changes of a block are forgotten, the state before it cannot be rebuilt
+	delete(stateHistory, 3)
+	if _, err := QueryContract(ContractQuery{Height: 2, Address: "contract:abi", Function: "load"}); err == nil {
+		t.Error("query past the history window error = nil")
+	}
+}
+
+func TestRecordStateForgetsOldBlocks(t *testing.T) {
+	resetState()
+	stateHistory = make(map[int]stateDiff)
+	window := GlobalConfig["stateHistory"]
+
+	for height := 1; height <= window+2; height++ {
+		recordState(height, takeSnapshot())
+	}
+	if len(stateHistory) != window {
+		t.Errorf("%d blocks recorded, want %d", len(stateHistory), window)
+	}
+	if _, ok := stateHistory[2]; ok {
+		t.Error("block 2 is still recorded after it fell out of the window")
+	}
+}
+
+func TestQueryContractIsReadOnly(t *testing.T) {
+	queryTestChain()
+
+	for _, function := range []string{"store", "delete", "pay"} {
+		result, err := QueryContract(ContractQuery{Address: "contract:abi", Function: function})
+		if err != nil {
+			t.Fatalf("%s: QueryContract() error = %v", function, err)
+		}
+		if !strings.Contains(result.Error, errReadOnlyQuery.Error()) {
+			t.Errorf("%s: result error = %q, want the query stopped", function, result.Error)
+		}
+	}
+
+	if value, _ := ContractStorage("contract:abi", "key"); string(value) != "valuevalue" {
+		t.Errorf("storage = %q, want it unchanged", value)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("query paid out %s", balance)
+	}
+
+	// Events of a query are returned, not recorded anywhere
+	result, err := QueryContract(ContractQuery{Address: "contract:abi", Function: "emit"})
+	if err != nil || len(result.Events) != 1 || result.Events[0].Type != "ping" {
+		t.Errorf("events = %v, %v, want the ping event", result.Events, err)
+	}
+	if result.GasUsed == 0 || result.GasUsed > GlobalConfig["maxQueryGas"] {
+		t.Errorf("gas used = %d, want it metered under maxQueryGas", result.GasUsed)
+	}
+}
+
+func TestQueryGasLimit(t *testing.T) {
+	limit := GlobalConfig["maxQueryGas"]
+
+	tests := []struct {
+		gasLimit int
+		want     int
+	}{
+		{0, limit},
+		{1000, 1000},
+		{limit, limit},
+		{GlobalConfig["maxGasLimit"], limit},
+	}
+
+	for _, tt := range tests {
+		if got := queryGasLimit(tt.gasLimit); got != tt.want {
+			t.Errorf("queryGasLimit(%d) = %d, want %d", tt.gasLimit, got, tt.want)
+		}
+	}
+}
+
+func TestSimulateTransaction(t *testing.T) {
+	resetState()
+	Blockchain = []Block{blockAt(0, time.Now().Unix())}
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	receipt := SimulateTransaction(Transaction{From: "alice", To: "bob", Amount: NewAmount(10), Fee: NewAmount(1)})
+	if receipt.Status != ReceiptSuccess || len(receipt.Events) != 1 {
+		t.Errorf("receipt = %+v, want a successful transfer", receipt)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("alice balance = %s, want the simulation discarded", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("bob balance = %s, want the simulation discarded", balance)
+	}
+	if _, ok := accountNonces["alice"]; ok {
+		t.Error("simulation used up a nonce")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+type ReceiptStatus int
+
+const (
+	ReceiptSuccess ReceiptStatus = iota
+	ReceiptFailed
+	ReceiptInvalid // The transaction cannot be included in the block, it had no effect, not even its fee
+)
+
+type Event struct {
+	Type       string
+	Attributes map[string]string
+}
+
+type Receipt struct {
+	TxHash   string
+	Status   ReceiptStatus
+	GasUsed  int
+	Fee      Amount
+	FeeDenom string
+	Events   []Event
+	Error    string // Why the transaction failed, empty on success
+}
+
+// ErrMalformedTransaction and ErrInvalidTransactionState explain why a receipt is ReceiptInvalid
+var (
+	ErrMalformedTransaction    = errors.New("transaction is malformed for the block")
+	ErrInvalidTransactionState = errors.New("transaction failed state checks")
+)
+
+// Maps transaction hashes to the receipts of the blocks they were included in
+var receiptIndex = make(map[string]Receipt)
+
+// executeTransaction checks a transaction against the block and the state left by the transactions before it,
+// then charges the fee and applies it, recording the outcome in a receipt. The transaction
+// sees the height and time of the block it executes in, never the local clock.
+func executeTransaction(tx Transaction, height int, now int64) Receipt {
+	receipt := checkTransaction(tx, height, now)
+	if receipt.Status == ReceiptInvalid {
+		return receipt
+	}
+
+	return runTransaction(tx, receipt, height, now)
+}
+
+// checkTransaction runs the checks a transaction must pass to be included in the block at the
+// given height and time and returns the receipt execution starts from, which is ReceiptInvalid
+// when the transaction cannot be included. The only state it changes is the sender's nonce,
+// which a transaction that passes uses up.
+func checkTransaction(tx Transaction, height int, now int64) Receipt {
+	receipt := Receipt{
+		TxHash: TransactionHash(tx),
+		Status: ReceiptSuccess,
+	}
+	tx.blockHeight = height
+	tx.blockTime = now
+
+	if !isTransactionWellFormed(tx) {
+		receipt.Status = ReceiptInvalid
+		receipt.Error = ErrMalformedTransaction.Error()
+		return receipt
+	}
+
+	if !hasNextNonce(tx) || !isTransactionStateValid(tx) {
+		receipt.Status = ReceiptInvalid
+		receipt.Error = ErrInvalidTransactionState.Error()
+		return receipt
+	}
+
+	useNonce(tx)
+	return receipt
+}
+
+// runTransaction charges the fee of a checked transaction and applies it, recording the outcome in its receipt
+func runTransaction(tx Transaction, receipt Receipt, height int, now int64) Receipt {
+	tx.receipt = &receipt
+	tx.blockHeight = height
+	tx.blockTime = now
+
+	// The fee is kept even if the transaction itself fails
+	err := chargeFee(tx)
+	if err != nil {
+		receipt.Status = ReceiptFailed
+		receipt.Error = err.Error()
+		return receipt
+	}
+	receipt.Fee, _ = maxFee(tx)
+	receipt.FeeDenom = denomOrNative(tx.FeeDenom)
+
+	err = applyTransaction(tx)
+	if err != nil {
+		log.Println(err)
+		receipt.Status = ReceiptFailed
+		receipt.Error = err.Error()
+		receipt.Events = nil
+	}
+
+	// Gas used by a failed transaction is paid for as well, only the unused gas is refunded
+	err = refundGas(tx)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return receipt
+}
+
+// chargeFee takes the fee and the cost of the whole gas limit from the fee payer
+func chargeFee(tx Transaction) error {
+	fee, err := maxFee(tx)
+	if err != nil {
+		return err
+	}
+
+	payer := feePayer(tx)
+	if spendableBalance(payer, tx.FeeDenom, tx.blockTime).LT(fee) {
+		return errors.New("insufficient balance to pay fee")
+	}
+
+	// Fees paid under a fee grant count against the granter's allowance
+	if usesFeeAllowance(tx) {
+		err := useFeeAllowance(tx, tx.blockHeight)
+		if err != nil {
+			return err
+		}
+	}
+
+	return spendBalance(payer, tx.FeeDenom, fee, tx.blockTime)
+}
+
+// refundGas returns the cost of the gas a transaction did not use to the fee payer
+func refundGas(tx Transaction) error {
+	refund, err := tx.GasPrice.MulInt(int64(tx.GasLimit - tx.receipt.GasUsed))
+	if err != nil || refund.IsZero() {
+		return err
+	}
+
+	err = addBalance(feePayer(tx), tx.FeeDenom, refund)
+	if err != nil {
+		return err
+	}
+
+	if usesFeeAllowance(tx) {
+		refundFeeAllowance(tx, refund)
+	}
+
+	tx.receipt.Fee, err = tx.receipt.Fee.Sub(refund)
+	return err
+}
+
+// emitEvent records an event in the receipt of the transaction being executed
+func emitEvent(tx Transaction, eventType string, attributes map[string]string) {
+	if tx.receipt == nil {
+		return
+	}
+
+	tx.receipt.Events = append(tx.receipt.Events, Event{Type: eventType, Attributes: attributes})
+}
+
+// calculateReceiptsRoot returns the root of a Merkle tree over the receipts of a block
+func calculateReceiptsRoot(receipts []Receipt) string {
+	if len(receipts) == 0 {
+		return ""
+	}
+
+	level := make([][]byte, len(receipts))
+	for i, receipt := range receipts {
+		encoded, err := json.Marshal(receipt)
+		if err != nil {
+			log.Println(err)
+			return ""
+		}
+		hashed := sha256.Sum256(encoded)
+		level[i] = hashed[:]
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			// An odd node out is paired with itself
+			left, right := level[i], level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			hashed := sha256.Sum256(append(append([]byte{}, left...), right...))
+			next = append(next, hashed[:])
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+func indexReceipts(block Block) {
+	for _, receipt := range block.Receipts {
+		receiptIndex[receipt.TxHash] = receipt
+	}
+}
+
+func GetReceipt(txHash string) (Receipt, error) {
+	receipt, ok := receiptIndex[txHash]
+	if !ok {
+		return Receipt{}, errors.New("receipt not found")
+	}
+
+	return receipt, nil
+}
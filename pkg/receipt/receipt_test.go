@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestCalculateReceiptsRoot(t *testing.T) {
+	a := Receipt{TxHash: "a"}
+	b := Receipt{TxHash: "b"}
+	c := Receipt{TxHash: "c"}
+
+	if root := calculateReceiptsRoot(nil); root != "" {
+		t.Errorf("root of no receipts = %q, want empty", root)
+	}
+
+	single := calculateReceiptsRoot([]Receipt{a})
+	if single == "" || single != calculateReceiptsRoot([]Receipt{a}) {
+		t.Errorf("root of one receipt = %q, want a stable non-empty root", single)
+	}
+
+	if calculateReceiptsRoot([]Receipt{a, b}) == calculateReceiptsRoot([]Receipt{b, a}) {
+		t.Error("root does not depend on the order of the receipts")
+	}
+
+	// The odd receipt out is paired with itself and still changes the root
+	odd := calculateReceiptsRoot([]Receipt{a, b, c})
+	if odd == calculateReceiptsRoot([]Receipt{a, b}) {
+		t.Error("root ignores the odd receipt")
+	}
+
+	failed := c
+	failed.Status = ReceiptFailed
+	if odd == calculateReceiptsRoot([]Receipt{a, b, failed}) {
+		t.Error("root does not depend on the receipt status")
+	}
+}
+
+func TestExecuteTransactionKeepsFeeOfFailedTransaction(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	tx := Transaction{
+		From: "alice",
+		Fee:  NewAmount(5),
+		Messages: []Message{
+			{Type: "transfer", To: "bob", Amount: NewAmount(10)},
+			{Type: "unstake", Amount: NewAmount(10)},
+		},
+	}
+	receipt := executeTransaction(tx, 1, 1000)
+
+	if receipt.Status != ReceiptFailed {
+		t.Fatalf("status = %v, want ReceiptFailed", receipt.Status)
+	}
+	if receipt.Error == "" {
+		t.Error("failed receipt has no error")
+	}
+	if len(receipt.Events) != 0 {
+		t.Errorf("failed receipt kept events: %v", receipt.Events)
+	}
+	if receipt.Fee.Cmp(NewAmount(5)) != 0 {
+		t.Errorf("receipt fee = %s, want 5", receipt.Fee)
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(95)) != 0 {
+		t.Errorf("alice balance = %s, want 95", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("bob balance = %s, want 0", balance)
+	}
+	if accountNonces["alice"] != 1 {
+		t.Errorf("nonce = %d, want the failed transaction to use it up", accountNonces["alice"])
+	}
+}
+
+func TestExecuteTransactionRecordsEvents(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	tx := Transaction{From: "alice", To: "bob", Amount: NewAmount(10)}
+	receipt := executeTransaction(tx, 1, 1000)
+
+	if receipt.Status != ReceiptSuccess {
+		t.Fatalf("status = %v, error = %q", receipt.Status, receipt.Error)
+	}
+	if receipt.TxHash != TransactionHash(tx) {
+		t.Errorf("receipt hash = %s, want %s", receipt.TxHash, TransactionHash(tx))
+	}
+	if len(receipt.Events) != 1 || receipt.Events[0].Type != "transfer" || receipt.Events[0].Attributes["to"] != "bob" {
+		t.Errorf("events = %v, want one transfer to bob", receipt.Events)
+	}
+}
+
+func TestExecuteTransactionInvalidHasNoEffect(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	// The nonce is ahead of the sender's
+	tx := Transaction{From: "alice", To: "bob", Amount: NewAmount(10), Fee: NewAmount(5), Nonce: 3}
+	receipt := executeTransaction(tx, 1, 1000)
+
+	if receipt.Status != ReceiptInvalid || receipt.Error != ErrInvalidTransactionState.Error() {
+		t.Fatalf("status = %v, error = %q, want ReceiptInvalid", receipt.Status, receipt.Error)
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("alice balance = %s, want 100, not even the fee is charged", balance)
+	}
+	if _, ok := accountNonces["alice"]; ok {
+		t.Error("invalid transaction used up a nonce")
+	}
+}
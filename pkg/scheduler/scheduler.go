@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A ScheduledTransfer is a payment registered on-chain to be executed by the
+// scheduler once the chain reaches its target height or timestamp. The amount
+// is held in escrow from the moment the transfer is scheduled.
+type ScheduledTransfer struct {
+	ID              string
+	From            string
+	To              string
+	Amount          Amount
+	Denom           string
+	ExecuteAtHeight int   // 0 if the transfer is not tied to a height
+	ExecuteAtTime   int64 // Unix time, 0 if the transfer is not tied to a timestamp
+}
+
+var scheduledTransfers []ScheduledTransfer
+
+func (s ScheduledTransfer) isDue(height int, now int64) bool {
+	if s.ExecuteAtHeight != 0 && height >= s.ExecuteAtHeight {
+		return true
+	}
+
+	return s.ExecuteAtTime != 0 && now >= s.ExecuteAtTime
+}
+
+func ScheduleTransaction(tx Transaction) error {
+	height, _ := dataInt(tx.Data, "height")
+	at, _ := dataInt(tx.Data, "time")
+	if height < 0 || at < 0 {
+		return errors.New("invalid target height or time")
+	}
+
+	if height == 0 && at == 0 {
+		return errors.New("scheduled transfer needs a target height or time")
+	}
+
+	if height != 0 && int(height) < tx.blockHeight {
+		return errors.New("target height has already passed")
+	}
+
+	if at != 0 && at < tx.blockTime {
+		return errors.New("target time has already passed")
+	}
+
+	if tx.Amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	id := executionID(tx)
+	for _, transfer := range scheduledTransfers {
+		if transfer.ID == id {
+			return fmt.Errorf("scheduled transfer already exists: %s", id)
+		}
+	}
+
+	// Hold the amount in escrow until the transfer is executed
+	err := spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return errors.New("insufficient balance to schedule transfer")
+	}
+
+	transfer := ScheduledTransfer{
+		ID:              id,
+		From:            tx.From,
+		To:              tx.To,
+		Amount:          tx.Amount,
+		Denom:           denomOrNative(tx.Denom),
+		ExecuteAtHeight: int(height),
+		ExecuteAtTime:   at,
+	}
+	journal.recordScheduledTransfers()
+	scheduledTransfers = append(scheduledTransfers, transfer)
+
+	emitEvent(tx, "schedule", map[string]string{
+		"id":     transfer.ID,
+		"from":   transfer.From,
+		"to":     transfer.To,
+		"amount": transfer.Amount.String(),
+		"denom":  transfer.Denom,
+	})
+
+	return nil
+}
+
+func CancelScheduleTransaction(tx Transaction) error {
+	id, ok := tx.Data["id"].(string)
+	if !ok {
+		return errors.New("invalid scheduled transfer id")
+	}
+
+	for i, transfer := range scheduledTransfers {
+		if transfer.ID != id {
+			continue
+		}
+
+		if transfer.From != tx.From {
+			return errors.New("only the sender can cancel a scheduled transfer")
+		}
+
+		// Refund the escrowed amount
+		err := addBalance(transfer.From, transfer.Denom, transfer.Amount)
+		if err != nil {
+			return err
+		}
+		journal.recordScheduledTransfers()
+		scheduledTransfers = append(scheduledTransfers[:i:i], scheduledTransfers[i+1:]...)
+
+		emitEvent(tx, "schedule_cancel", map[string]string{"id": id})
+		return nil
+	}
+
+	return fmt.Errorf("scheduled transfer not found: %s", id)
+}
+
+// runScheduledTransfers executes the transfers that are due in the block at the given height
+// and returns the events of the block for them. Transfers are executed in the order they
+// were scheduled.
+func runScheduledTransfers(height int, now int64) []Event {
+	var remaining []ScheduledTransfer
+	var events []Event
+
+	for _, transfer := range scheduledTransfers {
+		if !transfer.isDue(height, now) {
+			remaining = append(remaining, transfer)
+			continue
+		}
+
+		attributes := map[string]string{
+			"id":     transfer.ID,
+			"from":   transfer.From,
+			"to":     transfer.To,
+			"amount": transfer.Amount.String(),
+			"denom":  transfer.Denom,
+		}
+
+		err := addBalance(transfer.To, transfer.Denom, transfer.Amount)
+		if err != nil {
+			// Keep the transfer and retry it with the next block
+			attributes["error"] = err.Error()
+			events = append(events, Event{Type: "scheduled_transfer_deferred", Attributes: attributes})
+			remaining = append(remaining, transfer)
+			continue
+		}
+		events = append(events, Event{Type: "scheduled_transfer", Attributes: attributes})
+	}
+
+	scheduledTransfers = remaining
+	return events
+}
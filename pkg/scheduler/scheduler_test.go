@@ -0,0 +1,117 @@
+package main
+
+import "testing"
+
+func scheduleTx(data map[string]interface{}) Transaction {
+	return Transaction{
+		Type:        "schedule",
+		From:        "alice",
+		To:          "bob",
+		Amount:      NewAmount(10),
+		Data:        data,
+		blockHeight: 10,
+		blockTime:   1000,
+	}
+}
+
+func TestScheduleTransaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  map[string]interface{}
+		valid bool
+	}{
+		{"future height", map[string]interface{}{"height": 20}, true},
+		{"future time", map[string]interface{}{"time": 2000}, true},
+		{"current block", map[string]interface{}{"height": 10, "time": 1000}, true},
+		{"no target", map[string]interface{}{}, false},
+		{"past height", map[string]interface{}{"height": 9}, false},
+		{"past time", map[string]interface{}{"time": 999}, false},
+		{"negative height", map[string]interface{}{"height": -1, "time": 2000}, false},
+		{"negative time", map[string]interface{}{"height": 20, "time": -1}, false},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		addBalance("alice", NativeDenom, NewAmount(100))
+
+		err := ScheduleTransaction(scheduleTx(tt.data))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: ScheduleTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		want, scheduled := NewAmount(100), 0
+		if tt.valid {
+			want, scheduled = NewAmount(90), 1
+		}
+		if balance := getBalance("alice", NativeDenom); balance.Cmp(want) != 0 {
+			t.Errorf("%s: balance = %s, want %s", tt.name, balance, want)
+		}
+		if len(scheduledTransfers) != scheduled {
+			t.Errorf("%s: %d scheduled transfers, want %d", tt.name, len(scheduledTransfers), scheduled)
+		}
+	}
+}
+
+func TestRunScheduledTransfers(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	if err := ScheduleTransaction(scheduleTx(map[string]interface{}{"height": 12})); err != nil {
+		t.Fatalf("ScheduleTransaction() error = %v", err)
+	}
+	later := scheduleTx(map[string]interface{}{"time": 5000})
+	later.Amount = NewAmount(20)
+	if err := ScheduleTransaction(later); err != nil {
+		t.Fatalf("ScheduleTransaction() error = %v", err)
+	}
+
+	if events := runScheduledTransfers(11, 1100); len(events) != 0 {
+		t.Errorf("events before any transfer is due = %v", events)
+	}
+
+	events := runScheduledTransfers(12, 1200)
+	if len(events) != 1 || events[0].Type != "scheduled_transfer" || events[0].Attributes["amount"] != "10" {
+		t.Fatalf("events = %v, want the transfer of 10", events)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("bob balance = %s, want 10", balance)
+	}
+	if len(scheduledTransfers) != 1 || scheduledTransfers[0].Amount.Cmp(NewAmount(20)) != 0 {
+		t.Errorf("remaining transfers = %v, want the one due at time 5000", scheduledTransfers)
+	}
+
+	runScheduledTransfers(13, 5000)
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("bob balance = %s, want 30", balance)
+	}
+	if len(scheduledTransfers) != 0 {
+		t.Errorf("remaining transfers = %v, want none", scheduledTransfers)
+	}
+}
+
+func TestCancelScheduleTransaction(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	if err := ScheduleTransaction(scheduleTx(map[string]interface{}{"height": 20})); err != nil {
+		t.Fatalf("ScheduleTransaction() error = %v", err)
+	}
+	id := scheduledTransfers[0].ID
+
+	cancel := Transaction{From: "bob", Data: map[string]interface{}{"id": id}}
+	if err := CancelScheduleTransaction(cancel); err == nil {
+		t.Error("CancelScheduleTransaction() by the recipient error = nil")
+	}
+
+	cancel.From = "alice"
+	if err := CancelScheduleTransaction(cancel); err != nil {
+		t.Fatalf("CancelScheduleTransaction() error = %v", err)
+	}
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("balance = %s, want the escrow refunded", balance)
+	}
+	if len(scheduledTransfers) != 0 {
+		t.Errorf("remaining transfers = %v, want none", scheduledTransfers)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import "sync"
+
+// stateMutex is held while a block executes against the live state, so the
+// validation of new transactions never sees the state of a block that has not
+// been accepted yet
+var stateMutex = &sync.Mutex{}
+
+// A stateSnapshot is a copy of the chain state. Blocks are executed on top of a snapshot,
+// so a block that is not accepted leaves the state as it was.
+type stateSnapshot struct {
+	balances   map[balanceKey]Amount
+	validators map[string]Amount
+	nonces     map[string]uint64
+	proposals  []Proposal
+	scheduled  []ScheduledTransfer
+	allowances map[feeAllowanceKey]FeeAllowance
+	authz      map[authorizationKey]Authorization
+	denoms     map[string]DenomMetadata
+	vesting    map[string]VestingAccount
+	htlcs      map[string]HTLC
+	channels   map[string]PaymentChannel
+	storage    map[string]map[string][]byte
+	code       map[string][]byte
+	contracts  map[string]ContractInstance
+	deposits   map[string]map[string]Amount
+	tokens     map[string]Token
+	tokenAllow map[tokenAllowanceKey]Amount
+	nftColls   map[string]Collection
+	nfts       map[nftKey]NFT
+	nftOwners  map[string]map[nftKey]bool
+	nftsInColl map[string]map[nftKey]bool
+}
+
+func takeSnapshot() stateSnapshot {
+	return stateSnapshot{
+		balances:   copyBalances(balances),
+		validators: copyAmounts(validators),
+		nonces:     copyNonces(accountNonces),
+		proposals:  copyProposals(Proposals),
+		scheduled:  append([]ScheduledTransfer(nil), scheduledTransfers...),
+		allowances: copyFeeAllowances(feeAllowances),
+		authz:      copyAuthorizations(authorizations),
+		denoms:     copyDenoms(denoms),
+		vesting:    copyVestingAccounts(vestingAccounts),
+		htlcs:      copyHTLCs(htlcs),
+		channels:   copyPaymentChannels(paymentChannels),
+		storage:    copyContractStorage(contractStorage),
+		code:       copyContractCode(contractCode),
+		contracts:  copyContracts(contracts),
+		deposits:   copyStorageDeposits(storageDeposits),
+		tokens:     copyTokens(tokens),
+		tokenAllow: copyTokenAllowances(tokenAllowances),
+		nftColls:   copyCollections(nftCollections),
+		nfts:       copyNFTs(nfts),
+		nftOwners:  copyNFTIndex(nftsByOwner),
+		nftsInColl: copyNFTIndex(nftsByCollection),
+	}
+}
+
+// restoreSnapshot installs copies of the snapshot so it can be restored again later
+func restoreSnapshot(s stateSnapshot) {
+	balances = copyBalances(s.balances)
+	validators = copyAmounts(s.validators)
+	accountNonces = copyNonces(s.nonces)
+	Proposals = copyProposals(s.proposals)
+	scheduledTransfers = append([]ScheduledTransfer(nil), s.scheduled...)
+	feeAllowances = copyFeeAllowances(s.allowances)
+	authorizations = copyAuthorizations(s.authz)
+	denoms = copyDenoms(s.denoms)
+	vestingAccounts = copyVestingAccounts(s.vesting)
+	htlcs = copyHTLCs(s.htlcs)
+	paymentChannels = copyPaymentChannels(s.channels)
+	contractStorage = copyContractStorage(s.storage)
+	contractCode = copyContractCode(s.code)
+	contracts = copyContracts(s.contracts)
+	storageDeposits = copyStorageDeposits(s.deposits)
+	tokens = copyTokens(s.tokens)
+	tokenAllowances = copyTokenAllowances(s.tokenAllow)
+	nftCollections = copyCollections(s.nftColls)
+	nfts = copyNFTs(s.nfts)
+	nftsByOwner = copyNFTIndex(s.nftOwners)
+	nftsByCollection = copyNFTIndex(s.nftsInColl)
+}
+
+func copyBalances(m map[balanceKey]Amount) map[balanceKey]Amount {
+	c := make(map[balanceKey]Amount, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// A stateJournal records how to undo the state writes of the transaction being applied.
+// A failed transaction or contract call is rolled back by undoing its part of the journal,
+// which costs as much as it wrote, where a snapshot would copy the whole state.
+type stateJournal struct {
+	undo []func()
+}
+
+// journal records the writes of the transaction being applied, nil while none is.
+// Plain transfers run concurrently and are never journaled, see isPlainTransfer.
+var journal *stateJournal
+
+// journaled runs fn while recording its state writes and undoes them if it fails, or
+// always when discard is set. Called during a journaled operation it records into the
+// running journal and only undoes its own writes.
+func journaled(discard bool, fn func() error) error {
+	if journal == nil {
+		journal = &stateJournal{}
+		defer func() { journal = nil }()
+	}
+
+	mark := len(journal.undo)
+	err := fn()
+	if err != nil || discard {
+		journal.revert(mark)
+	}
+	return err
+}
+
+// record adds the undo of a write that is about to happen, outside a journal it does nothing
+func (j *stateJournal) record(undo func()) {
+	if j != nil {
+		j.undo = append(j.undo, undo)
+	}
+}
+
+func (j *stateJournal) revert(mark int) {
+	for i := len(j.undo) - 1; i >= mark; i-- {
+		j.undo[i]()
+	}
+	j.undo = j.undo[:mark]
+}
+
+// The record methods must be called before the entry they name is written
+
+func (j *stateJournal) recordBalance(key balanceKey) {
+	previous, ok := balances[key]
+	j.record(func() {
+		if ok {
+			balances[key] = previous
+		} else {
+			delete(balances, key)
+		}
+	})
+}
+
+func (j *stateJournal) recordNonce(account string) {
+	previous, ok := accountNonces[account]
+	j.record(func() {
+		if ok {
+			accountNonces[account] = previous
+		} else {
+			delete(accountNonces, account)
+		}
+	})
+}
+
+func (j *stateJournal) recordValidator(account string) {
+	previous, ok := validators[account]
+	j.record(func() {
+		if ok {
+			validators[account] = previous
+		} else {
+			delete(validators, account)
+		}
+	})
+}
+
+func (j *stateJournal) recordVote(proposal int, voter string) {
+	previous, ok := Proposals[proposal].Votes[voter]
+	j.record(func() {
+		if ok {
+			Proposals[proposal].Votes[voter] = previous
+		} else {
+			delete(Proposals[proposal].Votes, voter)
+		}
+	})
+}
+
+func (j *stateJournal) recordScheduledTransfers() {
+	previous := append([]ScheduledTransfer(nil), scheduledTransfers...)
+	j.record(func() {
+		scheduledTransfers = previous
+	})
+}
+
+func (j *stateJournal) recordFeeAllowance(key feeAllowanceKey) {
+	previous, ok := feeAllowances[key]
+	j.record(func() {
+		if ok {
+			feeAllowances[key] = previous
+		} else {
+			delete(feeAllowances, key)
+		}
+	})
+}
+
+func (j *stateJournal) recordAuthorization(key authorizationKey) {
+	previous, ok := authorizations[key]
+	j.record(func() {
+		if ok {
+			authorizations[key] = previous
+		} else {
+			delete(authorizations, key)
+		}
+	})
+}
+
+func (j *stateJournal) recordDenom(denom string) {
+	previous, ok := denoms[denom]
+	j.record(func() {
+		if ok {
+			denoms[denom] = previous
+		} else {
+			delete(denoms, denom)
+		}
+	})
+}
+
+func (j *stateJournal) recordVestingAccount(account string) {
+	previous, ok := vestingAccounts[account]
+	j.record(func() {
+		if ok {
+			vestingAccounts[account] = previous
+		} else {
+			delete(vestingAccounts, account)
+		}
+	})
+}
+
+func (j *stateJournal) recordHTLC(id string) {
+	previous, ok := htlcs[id]
+	j.record(func() {
+		if ok {
+			htlcs[id] = previous
+		} else {
+			delete(htlcs, id)
+		}
+	})
+}
+
+func (j *stateJournal) recordPaymentChannel(id string) {
+	previous, ok := paymentChannels[id]
+	j.record(func() {
+		if ok {
+			paymentChannels[id] = previous
+		} else {
+			delete(paymentChannels, id)
+		}
+	})
+}
+
+func (j *stateJournal) recordContractCode(hash string) {
+	previous, ok := contractCode[hash]
+	j.record(func() {
+		if ok {
+			contractCode[hash] = previous
+		} else {
+			delete(contractCode, hash)
+		}
+	})
+}
+
+func (j *stateJournal) recordContract(address string) {
+	previous, ok := contracts[address]
+	j.record(func() {
+		if ok {
+			contracts[address] = previous
+		} else {
+			delete(contracts, address)
+		}
+	})
+}
+
+// recordStorage covers a storage entry of a contract and the deposit paid for it
+func (j *stateJournal) recordStorage(address string, key string) {
+	value, stored := contractStorage[address][key]
+	deposit, paid := storageDeposits[address][key]
+	j.record(func() {
+		if stored {
+			if contractStorage[address] == nil {
+				contractStorage[address] = make(map[string][]byte)
+			}
+			contractStorage[address][key] = value
+		} else {
+			delete(contractStorage[address], key)
+			if len(contractStorage[address]) == 0 {
+				delete(contractStorage, address)
+			}
+		}
+
+		if paid {
+			if storageDeposits[address] == nil {
+				storageDeposits[address] = make(map[string]Amount)
+			}
+			storageDeposits[address][key] = deposit
+		} else {
+			delete(storageDeposits[address], key)
+			if len(storageDeposits[address]) == 0 {
+				delete(storageDeposits, address)
+			}
+		}
+	})
+}
+
+func (j *stateJournal) recordToken(denom string) {
+	previous, ok := tokens[denom]
+	j.record(func() {
+		if ok {
+			tokens[denom] = previous
+		} else {
+			delete(tokens, denom)
+		}
+	})
+}
+
+func (j *stateJournal) recordTokenAllowance(key tokenAllowanceKey) {
+	previous, ok := tokenAllowances[key]
+	j.record(func() {
+		if ok {
+			tokenAllowances[key] = previous
+		} else {
+			delete(tokenAllowances, key)
+		}
+	})
+}
+
+func (j *stateJournal) recordCollection(id string) {
+	previous, ok := nftCollections[id]
+	j.record(func() {
+		if ok {
+			nftCollections[id] = previous
+		} else {
+			delete(nftCollections, id)
+		}
+	})
+}
+
+// recordNFT covers an NFT and its entries in the owner and collection indices
+func (j *stateJournal) recordNFT(key nftKey) {
+	previous, ok := nfts[key]
+	j.record(func() {
+		if current, exists := nfts[key]; exists {
+			removeFromNFTIndex(nftsByOwner, current.Owner, key)
+			removeFromNFTIndex(nftsByCollection, current.Collection, key)
+		}
+
+		if ok {
+			nfts[key] = previous
+			addToNFTIndex(nftsByOwner, previous.Owner, key)
+			addToNFTIndex(nftsByCollection, previous.Collection, key)
+		} else {
+			delete(nfts, key)
+		}
+	})
+}
+
+func copyAmounts(m map[string]Amount) map[string]Amount {
+	c := make(map[string]Amount, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyNonces(m map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyProposals(proposals []Proposal) []Proposal {
+	c := make([]Proposal, len(proposals))
+	for i, proposal := range proposals {
+		c[i] = proposal
+		c[i].Votes = make(map[string]bool, len(proposal.Votes))
+		for node, vote := range proposal.Votes {
+			c[i].Votes[node] = vote
+		}
+		c[i].Delegations = make(map[string]string, len(proposal.Delegations))
+		for node, delegate := range proposal.Delegations {
+			c[i].Delegations[node] = delegate
+		}
+	}
+	return c
+}
+
+func copyFeeAllowances(m map[feeAllowanceKey]FeeAllowance) map[feeAllowanceKey]FeeAllowance {
+	c := make(map[feeAllowanceKey]FeeAllowance, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyAuthorizations(m map[authorizationKey]Authorization) map[authorizationKey]Authorization {
+	c := make(map[authorizationKey]Authorization, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyDenoms(m map[string]DenomMetadata) map[string]DenomMetadata {
+	c := make(map[string]DenomMetadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyVestingAccounts(m map[string]VestingAccount) map[string]VestingAccount {
+	c := make(map[string]VestingAccount, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyHTLCs(m map[string]HTLC) map[string]HTLC {
+	c := make(map[string]HTLC, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyPaymentChannels(m map[string]PaymentChannel) map[string]PaymentChannel {
+	c := make(map[string]PaymentChannel, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// copyContractStorage copies the key spaces of the contracts. Stored values are
+// replaced rather than modified, so they can be shared between the copies.
+func copyContractStorage(m map[string]map[string][]byte) map[string]map[string][]byte {
+	c := make(map[string]map[string][]byte, len(m))
+	for address, storage := range m {
+		c[address] = make(map[string][]byte, len(storage))
+		for k, v := range storage {
+			c[address][k] = v
+		}
+	}
+	return c
+}
+
+func copyContractCode(m map[string][]byte) map[string][]byte {
+	c := make(map[string][]byte, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyContracts(m map[string]ContractInstance) map[string]ContractInstance {
+	c := make(map[string]ContractInstance, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyStorageDeposits(m map[string]map[string]Amount) map[string]map[string]Amount {
+	c := make(map[string]map[string]Amount, len(m))
+	for address, deposits := range m {
+		c[address] = copyAmounts(deposits)
+	}
+	return c
+}
+
+func copyTokens(m map[string]Token) map[string]Token {
+	c := make(map[string]Token, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyTokenAllowances(m map[tokenAllowanceKey]Amount) map[tokenAllowanceKey]Amount {
+	c := make(map[tokenAllowanceKey]Amount, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyCollections(m map[string]Collection) map[string]Collection {
+	c := make(map[string]Collection, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyNFTs(m map[nftKey]NFT) map[nftKey]NFT {
+	c := make(map[nftKey]NFT, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyNFTIndex(m map[string]map[nftKey]bool) map[string]map[nftKey]bool {
+	c := make(map[string]map[nftKey]bool, len(m))
+	for k, keys := range m {
+		c[k] = make(map[nftKey]bool, len(keys))
+		for key := range keys {
+			c[k][key] = true
+		}
+	}
+	return c
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// genesisState is the state before any test changed it
+var genesisState = takeSnapshot()
+
+// resetState restores the genesis state, tests call it first since the state is global
+func resetState() {
+	restoreSnapshot(genesisState)
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+	snapshot := takeSnapshot()
+
+	addBalance("alice", NativeDenom, NewAmount(50))
+	validators["alice"] = NewAmount(10)
+	restoreSnapshot(snapshot)
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("balance = %s, want 100", balance)
+	}
+	if _, ok := validators["alice"]; ok {
+		t.Errorf("validator set was not restored: %v", validators)
+	}
+}
+
+func TestApplyTransactionRollsBackFailedMessage(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	tx := Transaction{
+		From: "alice",
+		Messages: []Message{
+			{Type: "stake", Amount: NewAmount(40)},
+			{Type: "transfer", To: "bob", Amount: NewAmount(30)},
+			{Type: "unstake", Amount: NewAmount(50)},
+		},
+	}
+	if err := applyTransaction(tx); err == nil {
+		t.Fatal("applyTransaction() error = nil, want the unstake to fail")
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("alice balance = %s, want 100", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("bob balance = %s, want 0", balance)
+	}
+	if _, ok := validators["alice"]; ok {
+		t.Errorf("stake was not rolled back: %v", validators)
+	}
+	if journal != nil {
+		t.Error("journal is still set after the transaction")
+	}
+}
+
+func TestApplyTransactionKeepsSuccessfulMessages(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	tx := Transaction{
+		From: "alice",
+		Messages: []Message{
+			{Type: "stake", Amount: NewAmount(40)},
+			{Type: "transfer", To: "bob", Amount: NewAmount(30)},
+		},
+	}
+	if err := applyTransaction(tx); err != nil {
+		t.Fatalf("applyTransaction() error = %v", err)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("alice balance = %s, want 30", balance)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("bob balance = %s, want 30", balance)
+	}
+	if stake := validators["alice"]; stake.Cmp(NewAmount(40)) != 0 {
+		t.Errorf("alice stake = %s, want 40", stake)
+	}
+}
+
+func TestJournaledNestedRevert(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	err := journaled(false, func() error {
+		if err := subBalance("alice", NativeDenom, NewAmount(10)); err != nil {
+			return err
+		}
+
+		// A failing inner operation only undoes its own writes
+		inner := journaled(false, func() error {
+			subBalance("alice", NativeDenom, NewAmount(20))
+			return errors.New("inner failure")
+		})
+		if inner == nil {
+			t.Error("inner journaled() error = nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("journaled() error = %v", err)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(90)) != 0 {
+		t.Errorf("balance = %s, want 90", balance)
+	}
+}
+
+func TestJournaledDiscard(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	err := journaled(true, func() error {
+		useNonce(Transaction{From: "alice", Nonce: 0})
+		return addBalance("bob", NativeDenom, NewAmount(5))
+	})
+	if err != nil {
+		t.Fatalf("journaled() error = %v", err)
+	}
+
+	if balance := getBalance("bob", NativeDenom); !balance.IsZero() {
+		t.Errorf("bob balance = %s, want 0", balance)
+	}
+	if nonce, ok := accountNonces["alice"]; ok {
+		t.Errorf("nonce = %d, want it removed", nonce)
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	resetState()
+
+	tx := Transaction{From: "alice", Nonce: 0}
+	if !hasNextNonce(tx) {
+		t.Fatal("hasNextNonce() = false for the first nonce")
+	}
+	useNonce(tx)
+
+	if hasNextNonce(tx) {
+		t.Error("hasNextNonce() = true for a used nonce")
+	}
+	if !hasNextNonce(Transaction{From: "alice", Nonce: 1}) {
+		t.Error("hasNextNonce() = false for the following nonce")
+	}
+	if !hasNextNonce(Transaction{From: "bob", Nonce: 0}) {
+		t.Error("nonces are not tracked per account")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const tokenPrefix = "factory/"
+
+// A Token is a fungible token created through the token factory. Its denomination
+// is registered like any other, so balances, fees and transfers work the same for it.
+// Token transactions take their amount from the "amount" data key and leave the
+// amount of the transaction empty.
+type Token struct {
+	Denom         string
+	Symbol        string
+	Decimals      int
+	Description   string
+	Creator       string
+	MintAuthority string // Account that can mint new tokens, empty once minting is disabled
+	Supply        Amount
+}
+
+type tokenAllowanceKey struct {
+	Denom   string
+	Owner   string
+	Spender string
+}
+
+var tokens = make(map[string]Token)
+
+// Maps owners and spenders to the amount the spender may move from the owner's balance
+var tokenAllowances = make(map[tokenAllowanceKey]Amount)
+
+// tokenDenom derives the denomination of a token from its creator and symbol
+func tokenDenom(creator string, symbol string) string {
+	hashed := sha256.Sum256([]byte(creator))
+	return tokenPrefix + hex.EncodeToString(hashed[:20]) + "/" + strings.ToLower(symbol)
+}
+
+func GetToken(denom string) (Token, error) {
+	token, ok := tokens[denom]
+	if !ok {
+		return Token{}, fmt.Errorf("token not found: %s", denom)
+	}
+	return token, nil
+}
+
+func GetTokenAllowance(denom string, owner string, spender string) Amount {
+	return tokenAllowances[tokenAllowanceKey{Denom: denom, Owner: owner, Spender: spender}]
+}
+
+// tokenAmount reads the amount of a token transaction from its data
+func tokenAmount(tx Transaction) (Amount, error) {
+	if !tx.Amount.IsZero() {
+		return Amount{}, errors.New("token transactions take their amount from the amount data key")
+	}
+
+	amount, ok := dataAmount(tx.Data, "amount")
+	if !ok {
+		return Amount{}, errors.New("invalid amount")
+	}
+	return amount, nil
+}
+
+// CreateTokenTransaction creates a token with the symbol, decimals and description in
+// the transaction data. The sender is the mint authority unless "mintAuthority" names another account.
+// Like any denomination registration it burns the denomRegistrationFee, unless governance creates it.
+func CreateTokenTransaction(tx Transaction) error {
+	symbol, ok := tx.Data["symbol"].(string)
+	if !ok || symbol == "" || strings.Contains(symbol, "/") {
+		return errors.New("invalid symbol")
+	}
+
+	decimals, _ := dataInt(tx.Data, "decimals")
+	if decimals < 0 || decimals > 18 {
+		return errors.New("invalid decimals")
+	}
+
+	denom := tokenDenom(tx.From, symbol)
+	if isKnownDenom(denom) {
+		return fmt.Errorf("denomination already registered: %s", denom)
+	}
+
+	description, _ := tx.Data["description"].(string)
+	mintAuthority, ok := tx.Data["mintAuthority"].(string)
+	if !ok {
+		mintAuthority = tx.From
+	}
+
+	if tx.From != GovernanceAddress {
+		fee := NewAmount(int64(GlobalConfig["denomRegistrationFee"]))
+		err := spendBalance(tx.From, NativeDenom, fee, tx.blockTime)
+		if err != nil {
+			return errors.New("insufficient balance to pay the denomination registration fee")
+		}
+	}
+
+	token := Token{
+		Denom:         denom,
+		Symbol:        symbol,
+		Decimals:      int(decimals),
+		Description:   description,
+		Creator:       tx.From,
+		MintAuthority: mintAuthority,
+	}
+	journal.recordToken(denom)
+	tokens[denom] = token
+
+	journal.recordDenom(denom)
+	denoms[denom] = DenomMetadata{
+		Denom:       denom,
+		Symbol:      symbol,
+		Decimals:    token.Decimals,
+		Description: description,
+		Issuer:      tx.From,
+	}
+
+	emitEvent(tx, "token_create", map[string]string{
+		"denom":         denom,
+		"symbol":        symbol,
+		"creator":       tx.From,
+		"mintAuthority": mintAuthority,
+	})
+
+	return nil
+}
+
+// MintTokenTransaction mints tokens to tx.To, or to the sender when it is empty
+func MintTokenTransaction(tx Transaction) error {
+	token, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	if token.MintAuthority == "" || tx.From != token.MintAuthority {
+		return errors.New("only the mint authority can mint the token")
+	}
+
+	amount, err := tokenAmount(tx)
+	if err != nil {
+		return err
+	}
+	if amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	token.Supply, err = token.Supply.Add(amount)
+	if err != nil {
+		return err
+	}
+
+	to := tx.To
+	if to == "" {
+		to = tx.From
+	}
+
+	err = addBalance(to, token.Denom, amount)
+	if err != nil {
+		return err
+	}
+	journal.recordToken(token.Denom)
+	tokens[token.Denom] = token
+
+	emitEvent(tx, "token_mint", map[string]string{"denom": token.Denom, "to": to, "amount": amount.String()})
+
+	return nil
+}
+
+// SetMintAuthorityTokenTransaction hands minting over to the "mintAuthority" account.
+// Leaving it empty disables minting for good.
+func SetMintAuthorityTokenTransaction(tx Transaction) error {
+	token, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	if token.MintAuthority == "" || tx.From != token.MintAuthority {
+		return errors.New("only the mint authority can change the mint authority")
+	}
+
+	mintAuthority, _ := tx.Data["mintAuthority"].(string)
+	token.MintAuthority = mintAuthority
+	journal.recordToken(token.Denom)
+	tokens[token.Denom] = token
+
+	emitEvent(tx, "token_set_mint_authority", map[string]string{"denom": token.Denom, "mintAuthority": mintAuthority})
+
+	return nil
+}
+
+func TransferTokenTransaction(tx Transaction) error {
+	_, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	amount, err := tokenAmount(tx)
+	if err != nil {
+		return err
+	}
+	if amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	tx.Amount = amount
+	return TransferTransaction(tx)
+}
+
+// ApproveTokenTransaction lets tx.To move up to the amount from the sender's balance.
+// A new approval replaces the previous one, a zero amount revokes it.
+func ApproveTokenTransaction(tx Transaction) error {
+	if tx.To == "" || tx.To == tx.From {
+		return errors.New("invalid spender")
+	}
+
+	_, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	amount, err := tokenAmount(tx)
+	if err != nil {
+		return err
+	}
+
+	key := tokenAllowanceKey{Denom: tx.Denom, Owner: tx.From, Spender: tx.To}
+	journal.recordTokenAllowance(key)
+	if amount.IsZero() {
+		delete(tokenAllowances, key)
+	} else {
+		tokenAllowances[key] = amount
+	}
+
+	emitEvent(tx, "token_approve", map[string]string{
+		"denom":   tx.Denom,
+		"owner":   tx.From,
+		"spender": tx.To,
+		"amount":  amount.String(),
+	})
+
+	return nil
+}
+
+// TransferFromTokenTransaction moves tokens from the "owner" account to tx.To under the sender's allowance
+func TransferFromTokenTransaction(tx Transaction) error {
+	owner, _ := tx.Data["owner"].(string)
+	if owner == "" || tx.To == "" {
+		return errors.New("invalid owner or recipient")
+	}
+
+	_, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	amount, err := tokenAmount(tx)
+	if err != nil {
+		return err
+	}
+	if amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	key := tokenAllowanceKey{Denom: tx.Denom, Owner: owner, Spender: tx.From}
+	remaining, err := tokenAllowances[key].Sub(amount)
+	if err != nil {
+		return errors.New("token allowance exceeded")
+	}
+
+	err = spendBalance(owner, tx.Denom, amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(tx.To, tx.Denom, amount)
+	if err != nil {
+		return err
+	}
+
+	journal.recordTokenAllowance(key)
+	if remaining.IsZero() {
+		delete(tokenAllowances, key)
+	} else {
+		tokenAllowances[key] = remaining
+	}
+
+	emitEvent(tx, "token_transfer_from", map[string]string{
+		"denom":   tx.Denom,
+		"owner":   owner,
+		"spender": tx.From,
+		"to":      tx.To,
+		"amount":  amount.String(),
+	})
+
+	return nil
+}
+
+func BurnTokenTransaction(tx Transaction) error {
+	token, err := GetToken(tx.Denom)
+	if err != nil {
+		return err
+	}
+
+	amount, err := tokenAmount(tx)
+	if err != nil {
+		return err
+	}
+	if amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	err = spendBalance(tx.From, token.Denom, amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	token.Supply, err = token.Supply.Sub(amount)
+	if err != nil {
+		return err
+	}
+	journal.recordToken(token.Denom)
+	tokens[token.Denom] = token
+
+	emitEvent(tx, "token_burn", map[string]string{"denom": token.Denom, "from": tx.From, "amount": amount.String()})
+
+	return nil
+}
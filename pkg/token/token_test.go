@@ -0,0 +1,220 @@
+package main
+
+import "testing"
+
+// createToken creates the token tok of alice, who pays the registration fee
+func createToken(t *testing.T, data map[string]interface{}) string {
+	t.Helper()
+
+	addBalance("alice", NativeDenom, NewAmount(int64(GlobalConfig["denomRegistrationFee"])))
+	data["symbol"] = "tok"
+	if err := CreateTokenTransaction(Transaction{From: "alice", Data: data}); err != nil {
+		t.Fatalf("CreateTokenTransaction() error = %v", err)
+	}
+	return tokenDenom("alice", "tok")
+}
+
+func TestCreateTokenTransaction(t *testing.T) {
+	resetState()
+	fee := int64(GlobalConfig["denomRegistrationFee"])
+	addBalance("alice", NativeDenom, NewAmount(fee+10))
+
+	create := Transaction{From: "alice", Data: map[string]interface{}{"symbol": "TOK", "decimals": 6, "description": "Test token"}}
+	if err := CreateTokenTransaction(create); err != nil {
+		t.Fatalf("CreateTokenTransaction() error = %v", err)
+	}
+	denom := tokenDenom("alice", "tok")
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("alice balance = %s, want the registration fee burned", balance)
+	}
+	token, err := GetToken(denom)
+	if err != nil || token.Creator != "alice" || token.MintAuthority != "alice" || token.Decimals != 6 || !token.Supply.IsZero() {
+		t.Errorf("token = %+v, %v", token, err)
+	}
+	if metadata := denoms[denom]; metadata.Symbol != "TOK" || metadata.Issuer != "alice" {
+		t.Errorf("denomination metadata = %+v", metadata)
+	}
+
+	tests := []struct {
+		name string
+		from string
+		data map[string]interface{}
+	}{
+		{"same symbol again", "alice", map[string]interface{}{"symbol": "tok"}},
+		{"symbol with a slash", "alice", map[string]interface{}{"symbol": "a/b"}},
+		{"too many decimals", "alice", map[string]interface{}{"symbol": "big", "decimals": 19}},
+		{"fee not covered", "alice", map[string]interface{}{"symbol": "other"}},
+	}
+	for _, tt := range tests {
+		if err := CreateTokenTransaction(Transaction{From: tt.from, Data: tt.data}); err == nil {
+			t.Errorf("%s: CreateTokenTransaction() error = nil", tt.name)
+		}
+	}
+	if len(tokens) != 1 {
+		t.Errorf("%d tokens, want only the first one created", len(tokens))
+	}
+
+	// Governance creates tokens without paying the fee
+	if err := CreateTokenTransaction(Transaction{From: GovernanceAddress, Data: map[string]interface{}{"symbol": "gov"}}); err != nil {
+		t.Errorf("CreateTokenTransaction() by governance error = %v", err)
+	}
+}
+
+func TestMintAuthority(t *testing.T) {
+	resetState()
+	denom := createToken(t, map[string]interface{}{"decimals": 6})
+
+	mint := func(from string) Transaction {
+		return Transaction{From: from, Denom: denom, Data: map[string]interface{}{"amount": 10}}
+	}
+	handOver := func(from string, to string) Transaction {
+		return Transaction{From: from, Denom: denom, Data: map[string]interface{}{"mintAuthority": to}}
+	}
+
+	tests := []struct {
+		name    string
+		handler func(Transaction) error
+		tx      Transaction
+		valid   bool
+	}{
+		{"creator mints", MintTokenTransaction, mint("alice"), true},
+		{"other account mints", MintTokenTransaction, mint("bob"), false},
+		{"other account takes over", SetMintAuthorityTokenTransaction, handOver("bob", "bob"), false},
+		{"creator hands over", SetMintAuthorityTokenTransaction, handOver("alice", "bob"), true},
+		{"former authority mints", MintTokenTransaction, mint("alice"), false},
+		{"new authority mints", MintTokenTransaction, mint("bob"), true},
+		{"minting disabled", SetMintAuthorityTokenTransaction, handOver("bob", ""), true},
+		{"mint after disabling", MintTokenTransaction, mint("bob"), false},
+		{"enable after disabling", SetMintAuthorityTokenTransaction, handOver("", "bob"), false},
+	}
+
+	for _, tt := range tests {
+		err := tt.handler(tt.tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	token, _ := GetToken(denom)
+	if token.Supply.Cmp(NewAmount(20)) != 0 {
+		t.Errorf("supply = %s, want 20", token.Supply)
+	}
+	if balance := getBalance("alice", denom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("alice balance = %s, want 10", balance)
+	}
+	if balance := getBalance("bob", denom); balance.Cmp(NewAmount(10)) != 0 {
+		t.Errorf("bob balance = %s, want 10", balance)
+	}
+}
+
+func TestTokenAmounts(t *testing.T) {
+	resetState()
+	denom := createToken(t, map[string]interface{}{})
+
+	tests := []struct {
+		name string
+		tx   Transaction
+	}{
+		{"amount of the transaction", Transaction{From: "alice", Denom: denom, Amount: NewAmount(10)}},
+		{"missing amount", Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{}}},
+		{"negative amount", Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{"amount": -1}}},
+		{"zero amount", Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{"amount": 0}}},
+	}
+	for _, tt := range tests {
+		if err := MintTokenTransaction(tt.tx); err == nil {
+			t.Errorf("%s: MintTokenTransaction() error = nil", tt.name)
+		}
+	}
+
+	token, _ := GetToken(denom)
+	if !token.Supply.IsZero() {
+		t.Errorf("supply = %s, want nothing minted", token.Supply)
+	}
+}
+
+func TestApproveTokenTransaction(t *testing.T) {
+	resetState()
+	denom := createToken(t, map[string]interface{}{})
+
+	approve := func(data map[string]interface{}) error {
+		return ApproveTokenTransaction(Transaction{From: "alice", To: "bob", Denom: denom, Data: data})
+	}
+
+	if err := approve(map[string]interface{}{"amount": 30}); err != nil {
+		t.Fatalf("ApproveTokenTransaction() error = %v", err)
+	}
+	for _, data := range []map[string]interface{}{{}, {"amount": "abc"}} {
+		if err := approve(data); err == nil {
+			t.Errorf("ApproveTokenTransaction(%v) error = nil", data)
+		}
+	}
+	if allowance := GetTokenAllowance(denom, "alice", "bob"); allowance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("allowance = %s, want 30 after the invalid approvals", allowance)
+	}
+
+	if err := approve(map[string]interface{}{"amount": 0}); err != nil {
+		t.Fatalf("ApproveTokenTransaction() error = %v", err)
+	}
+	if len(tokenAllowances) != 0 {
+		t.Errorf("allowances = %v, want the approval revoked", tokenAllowances)
+	}
+}
+
+func TestTransferFromToken(t *testing.T) {
+	resetState()
+	denom := createToken(t, map[string]interface{}{})
+	addBalance("alice", denom, NewAmount(100))
+	ApproveTokenTransaction(Transaction{From: "alice", To: "bob", Denom: denom, Data: map[string]interface{}{"amount": 30}})
+
+	tests := []struct {
+		name   string
+		from   string
+		amount int
+		valid  bool
+	}{
+		{"within allowance", "bob", 20, true},
+		{"beyond remaining allowance", "bob", 20, false},
+		{"rest of allowance", "bob", 10, true},
+		{"without allowance", "carol", 1, false},
+	}
+
+	for _, tt := range tests {
+		tx := Transaction{From: tt.from, To: "dave", Denom: denom, Data: map[string]interface{}{"owner": "alice", "amount": tt.amount}}
+		err := TransferFromTokenTransaction(tx)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: TransferFromTokenTransaction() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	if balance := getBalance("dave", denom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("recipient balance = %s, want 30", balance)
+	}
+	if balance := getBalance("alice", denom); balance.Cmp(NewAmount(70)) != 0 {
+		t.Errorf("owner balance = %s, want 70", balance)
+	}
+	if allowance := GetTokenAllowance(denom, "alice", "bob"); !allowance.IsZero() {
+		t.Errorf("allowance left = %s, want 0", allowance)
+	}
+}
+
+func TestBurnTokenTransaction(t *testing.T) {
+	resetState()
+	denom := createToken(t, map[string]interface{}{})
+	MintTokenTransaction(Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{"amount": 50}})
+
+	if err := BurnTokenTransaction(Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{"amount": 60}}); err == nil {
+		t.Error("BurnTokenTransaction() beyond the balance error = nil")
+	}
+	if err := BurnTokenTransaction(Transaction{From: "alice", Denom: denom, Data: map[string]interface{}{"amount": 20}}); err != nil {
+		t.Fatalf("BurnTokenTransaction() error = %v", err)
+	}
+
+	token, _ := GetToken(denom)
+	if token.Supply.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("supply = %s, want 30", token.Supply)
+	}
+	if balance := getBalance("alice", denom); balance.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("alice balance = %s, want 30", balance)
+	}
+}
@@ -1,80 +1,189 @@
 package main
 
 import (
+	"crypto"
 	"crypto/sha256"
 	"crypto/rsa"
 	"crypto/rand"
 	"log"
+	"time"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"crypto/x509"
 )
 
 type Transaction struct {
-	From      string
-	To        string
-	Amount    int
-	Fee       int
-	Signature string
-	Contract  *SmartContract
+	Type       string // Key in TransactionTypes, inferred from the other fields when empty
+	From       string
+	To         string
+	Amount     Amount
+	Denom      string // Denomination of Amount, the native coin when empty
+	Fee        Amount
+	FeeDenom   string // Denomination of Fee, the native coin when empty
+	Signature  string
+	Signatures map[string]string // Maps public keys to their signatures for multisig senders
+	Multisig   *MultisigAccount  // Set when From is a multisig address
+	Contract   *SmartContract
+	Data       map[string]interface{}
+	Messages   []Message // Executed in order and atomically instead of the fields above
+	Nonce      uint64    // Number of transactions of the sender included in blocks before this one
+
+	ValidAfter  int64 // Unix time before which the transaction cannot be included, 0 for no bound
+	ValidBefore int64 // Unix time from which the transaction can no longer be included, 0 for no bound
+
+	ExpiryHeight int // Last block height the transaction can be included in, 0 if it never expires
+
+	FeePayer          string // Account paying the fee instead of the sender
+	FeePayerSignature string // Signature of the fee payer, empty when the fee is covered by a fee allowance
+
+	Granter string // Account the sender acts on behalf of under an authorization
+
+	ConsentSignatures map[string]string // Maps recipients to their signatures for messages that need their consent, such as vesting_create
+
+	GasLimit int    // Most gas contract execution may use, required for contract transactions
+	GasPrice Amount // Price of a unit of gas in FeeDenom, on top of Fee
+
+	receipt     *Receipt // Receipt being built while the transaction executes
+	message     int      // Position of the message being executed counted from 1, 0 for the transaction itself
+	blockHeight int      // Height of the block the transaction is checked or executed for
+	blockTime   int64    // Unix time of that block, execution never reads the local clock
 }
 
 type SmartContract struct {
-	Code []byte
-	Data map[string]interface{}
+	Code     []byte // Code to deploy, empty when calling a deployed contract
+	Data     map[string]interface{}
+	Address  string  // Deployed contract to call
+	Function string  // Exported function to call, main when empty
+	Args     []int64 // Arguments passed to the function
 }
 
+// isTransactionValid runs the checks of the validation phases against the current state.
+// A transaction goes through three phases: the stateless checks of its signatures and
+// format, the stateful checks of balances, grants and replays, and execution. Only
+// execution changes state and it only happens while a block is built.
 func isTransactionValid(tx Transaction) bool {
-	// Check if the signature is valid
-	if !isValidSignature(tx) {
+	// A new transaction is checked as if it was included in the next block
+	tx.blockHeight = currentHeight() + 1
+	tx.blockTime = time.Now().Unix()
+
+	// The nonce may be ahead of the sender's while its earlier transactions are pending
+	if tx.Nonce < accountNonces[tx.From] {
 		return false
 	}
 
-	// Check if the sender has enough balance for the transaction
-	if !hasEnoughBalance(tx) {
+	return hasValidSignatures(tx) && isTransactionWellFormed(tx) && isTransactionStateValid(tx)
+}
+
+// hasValidSignatures checks the signatures of the sender, of the fee payer and of the
+// recipients that must consent. It does not read any state, so it can run concurrently
+// for many transactions.
+func hasValidSignatures(tx Transaction) bool {
+	// Check if the signature is valid
+	if !isValidSignature(tx) {
 		return false
 	}
 
-	// Check if the transaction has not been processed before
-	if isDoubleSpending(tx) {
+	// Check if the fee payer agreed to pay the fee
+	if !isValidFeePayer(tx) {
 		return false
 	}
 
-	// Execute the smart contract (if any)
-	if tx.Contract != nil {
-		vm, err := exec.NewVirtualMachine(tx.Contract.Code, exec.VMConfig{}, nil, nil)
-		if err != nil {
-			log.Println(err)
+	// Check if the recipients of new vesting accounts agreed to them
+	return hasVestingConsent(tx)
+}
+
+// isTransactionWellFormed checks the format of a transaction without reading any state
+func isTransactionWellFormed(tx Transaction) bool {
+	// Check if the transaction and its messages have supported types
+	for _, txType := range transactionTypes(tx) {
+		if _, ok := TransactionTypes[txType]; !ok {
 			return false
 		}
+	}
 
-		_, err = vm.Run(tx.Contract.Code)
-		if err != nil {
-			log.Println(err)
+	// Check if authorizations are only granted for supported types
+	for _, msgType := range grantedTypes(tx) {
+		if _, ok := TransactionTypes[msgType]; !ok {
 			return false
 		}
 	}
 
-	return true
+	// Check if the transaction has expired before the block it is checked for
+	if isExpired(tx, tx.blockHeight) {
+		return false
+	}
+
+	// Check if the transaction is inside its validity window
+	if !isWithinValidityWindow(tx, tx.blockTime) {
+		return false
+	}
+
+	// Check if the gas limit is within the chain's bounds
+	return tx.GasLimit >= 0 && tx.GasLimit <= GlobalConfig["maxGasLimit"]
+}
+
+// isTransactionStateValid checks a transaction against the current state without changing it
+func isTransactionStateValid(tx Transaction) bool {
+	// Check if the sender is authorized to act for the granter
+	if !isValidAuthorization(tx) {
+		return false
+	}
+
+	// Check if the fee allowance covers the fee
+	if !hasFeeAllowance(tx) {
+		return false
+	}
+
+	// Check if the amounts and fee use registered denominations
+	if !hasKnownDenoms(tx) {
+		return false
+	}
+
+	// Check if the sender has enough balance for the transaction
+	return hasEnoughBalance(tx)
+}
+
+// Maps accounts to the nonce their next transaction must carry
+var accountNonces = make(map[string]uint64)
+
+// hasNextNonce checks that a transaction carries the next nonce of its sender. Every
+// transaction included in a block uses up its nonce, so it can never be included again,
+// not even later in the same block.
+func hasNextNonce(tx Transaction) bool {
+	return tx.Nonce == accountNonces[tx.From]
+}
+
+// useNonce uses up the nonce of a transaction included in a block, even if it fails
+func useNonce(tx Transaction) {
+	journal.recordNonce(tx.From)
+	accountNonces[tx.From] = tx.Nonce + 1
 }
 
 func isValidSignature(tx Transaction) bool {
+	// Multisig senders are checked against their threshold instead
+	if tx.Multisig != nil {
+		return isValidMultisig(tx)
+	}
+
 	// Convert the public key from string to *rsa.PublicKey
 	pubKey := convertPublicKey(tx.From)
+	if pubKey == nil {
+		return false
+	}
 
-	// Create a new hash
-	hash := sha256.New()
-
-	// Write the transaction data to the hash
-	_, err := hash.Write([]byte(tx.Data)) // assuming tx.Data contains the transaction data
-	if err != nil {
-		log.Println(err)
+	// Hash the signed payload of the transaction
+	hashed := transactionHash(tx)
+	if hashed == nil {
 		return false
 	}
-	hashed := hash.Sum(nil)
 
+	return verifySignature(pubKey, hashed, tx.Signature)
+}
+
+func verifySignature(pubKey *rsa.PublicKey, hashed []byte, sig string) bool {
 	// Decode the signature
-	signature, err := hex.DecodeString(tx.Signature)
+	signature, err := hex.DecodeString(sig)
 	if err != nil {
 		log.Println(err)
 		return false
@@ -90,28 +199,153 @@ func isValidSignature(tx Transaction) bool {
 	return true
 }
 
+// transactionHash returns the SHA-256 digest of the signed payload of a transaction.
+// The signatures are cleared first so that every signer signs the same bytes.
+func transactionHash(tx Transaction) []byte {
+	tx.Signature = ""
+	tx.Signatures = nil
+	tx.FeePayerSignature = ""
+	tx.ConsentSignatures = nil
+
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	hashed := sha256.Sum256(payload)
+	return hashed[:]
+}
+
+// TransactionHash identifies a signed transaction, it is the key for receipt lookups
+func TransactionHash(tx Transaction) string {
+	encoded, err := json.Marshal(tx)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	hashed := sha256.Sum256(encoded)
+	return hex.EncodeToString(hashed[:])
+}
+
 func hasEnoughBalance(tx Transaction) bool {
-	// Check the sender's balance
-	balance := balances[tx.From]
-	// Check if the sender's balance is less than the amount
-	if balance < tx.Amount {
+	// Amounts move out of the granter's account when acting under an authorization
+	spender := tx.From
+	if tx.Granter != "" {
+		spender = tx.Granter
+	}
+	required, err := requiredAmounts(tx)
+	if err != nil {
+		return false
+	}
+
+	// Check if the fee payer can cover the fee and the whole gas limit
+	fee, err := maxFee(tx)
+	if err != nil {
+		return false
+	}
+
+	payer := feePayer(tx)
+	if payer == spender {
+		err = addAmount(required, tx.FeeDenom, fee)
+		if err != nil {
+			return false
+		}
+	} else if spendableBalance(payer, tx.FeeDenom, tx.blockTime).LT(fee) {
 		return false
 	}
+
+	for denom, amount := range required {
+		// Check the sender's balance, locked vesting coins cannot be spent
+		balance := spendableBalance(spender, denom, tx.blockTime)
+		// Check if the sender's balance is less than the amount
+		if balance.LT(amount) {
+			return false
+		}
+	}
 	return true
 }
 
-func isDoubleSpending(tx Transaction) bool {
-	for _, block := range Blockchain {
-		for _, transaction := range block.Transactions {
-			// Compare transaction details to check for identical transactions
-			if tx.From == transaction.From && tx.To == transaction.To && tx.Amount == transaction.Amount {
-				return true
-			}
+// maxFee is the fee plus the cost of the whole gas limit, it is reserved before the transaction runs
+func maxFee(tx Transaction) (Amount, error) {
+	gasCost, err := tx.GasPrice.MulInt(int64(tx.GasLimit))
+	if err != nil {
+		return Amount{}, err
+	}
+
+	return tx.Fee.Add(gasCost)
+}
+
+func isExpired(tx Transaction, height int) bool {
+	return tx.ExpiryHeight != 0 && height > tx.ExpiryHeight
+}
+
+func isWithinValidityWindow(tx Transaction, now int64) bool {
+	if tx.ValidAfter != 0 && now < tx.ValidAfter {
+		return false
+	}
+
+	if tx.ValidBefore != 0 && now >= tx.ValidBefore {
+		return false
+	}
+
+	return true
+}
+
+// requiredAmounts returns the amounts per denomination a transaction moves out of the sender's account
+func requiredAmounts(tx Transaction) (map[string]Amount, error) {
+	required := make(map[string]Amount)
+
+	err := addAmount(required, tx.Denom, tx.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range tx.Messages {
+		err = addAmount(required, msg.Denom, msg.Amount)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return false
+	return required, nil
 }
 
+// addAmount adds an amount to the total of its denomination
+func addAmount(totals map[string]Amount, denom string, amount Amount) error {
+	total, err := totals[denomOrNative(denom)].Add(amount)
+	if err != nil {
+		return err
+	}
+
+	totals[denomOrNative(denom)] = total
+	return nil
+}
+
+func TransferTransaction(tx Transaction) error {
+	err := spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(tx.To, tx.Denom, tx.Amount)
+	if err != nil {
+		// Plain transfers are not journaled, so undo the debit here
+		addBalance(tx.From, tx.Denom, tx.Amount)
+		return err
+	}
+
+	emitEvent(tx, "transfer", map[string]string{
+		"from":   tx.From,
+		"to":     tx.To,
+		"amount": tx.Amount.String(),
+		"denom":  denomOrNative(tx.Denom),
+	})
+
+	return nil
+}
+
+
 
 func convertPublicKey(pubKeyStr string) *rsa.PublicKey {
 	// Decode the public key from PEM format
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	ContinuousVesting = "continuous" // Unlocks linearly between StartTime and EndTime
+	DelayedVesting    = "delayed"    // Unlocks everything at EndTime
+	PeriodicVesting   = "periodic"   // Unlocks the amount of each period when it ends
+)
+
+type VestingPeriod struct {
+	Length int64 // Seconds from the end of the previous period, or from StartTime for the first one
+	Amount Amount
+}
+
+// A VestingAccount holds coins that unlock over time. Locked coins cannot be
+// transferred or used for fees, but they can be staked.
+type VestingAccount struct {
+	Address          string
+	Type             string
+	Denom            string
+	OriginalVesting  Amount
+	StartTime        int64
+	EndTime          int64
+	Periods          []VestingPeriod
+	DelegatedVesting Amount // Staked coins that were locked when they were staked
+	DelegatedFree    Amount // Staked coins that were unlocked when they were staked
+}
+
+var vestingAccounts = make(map[string]VestingAccount)
+
+// vestingConsentDomain tags the payload the recipient of a vesting account signs
+const vestingConsentDomain = "kiwi/vesting-consent/"
+
+func (va VestingAccount) vestedAmount(now int64) Amount {
+	switch va.Type {
+	case ContinuousVesting:
+		if now <= va.StartTime {
+			return Amount{}
+		}
+		if now >= va.EndTime {
+			return va.OriginalVesting
+		}
+
+		elapsed := big.NewInt(now - va.StartTime)
+		duration := big.NewInt(va.EndTime - va.StartTime)
+		vested, err := newAmountFromBig(new(big.Int).Div(new(big.Int).Mul(va.OriginalVesting.bigInt(), elapsed), duration))
+		if err != nil {
+			return Amount{}
+		}
+		return vested
+	case DelayedVesting:
+		if now >= va.EndTime {
+			return va.OriginalVesting
+		}
+		return Amount{}
+	case PeriodicVesting:
+		vested := Amount{}
+		end := va.StartTime
+		for _, period := range va.Periods {
+			end += period.Length
+			if now < end {
+				break
+			}
+
+			total, err := vested.Add(period.Amount)
+			if err != nil {
+				break
+			}
+			vested = total
+		}
+		return vested
+	}
+
+	return va.OriginalVesting
+}
+
+func (va VestingAccount) lockedAmount(now int64) Amount {
+	locked, err := va.OriginalVesting.Sub(va.vestedAmount(now))
+	if err != nil {
+		return Amount{}
+	}
+	return locked
+}
+
+// spendableBalance returns the part of a balance that can be transferred or used for fees
+func spendableBalance(account string, denom string, now int64) Amount {
+	balance := getBalance(account, denom)
+
+	va, ok := vestingAccounts[account]
+	if !ok || va.Denom != denomOrNative(denom) {
+		return balance
+	}
+
+	// Locked coins may be staked, so only the locked part that is not staked is held back
+	locked, err := va.lockedAmount(now).Sub(va.DelegatedVesting)
+	if err != nil {
+		locked = Amount{}
+	}
+
+	spendable, err := balance.Sub(locked)
+	if err != nil {
+		return Amount{}
+	}
+	return spendable
+}
+
+// trackDelegation records a new stake of a vesting account. Locked coins are staked
+// before unlocked ones, so staking unlocked coins never makes locked ones spendable.
+func trackDelegation(account string, amount Amount, now int64) error {
+	va, ok := vestingAccounts[account]
+	if !ok || va.Denom != NativeDenom {
+		return nil
+	}
+
+	// The locked coins that are still in the balance
+	unstaked, err := va.lockedAmount(now).Sub(va.DelegatedVesting)
+	if err != nil {
+		unstaked = Amount{}
+	}
+
+	fromLocked := minAmount(unstaked, amount)
+	fromFree, err := amount.Sub(fromLocked)
+	if err != nil {
+		return err
+	}
+
+	va.DelegatedVesting, err = va.DelegatedVesting.Add(fromLocked)
+	if err != nil {
+		return err
+	}
+	va.DelegatedFree, err = va.DelegatedFree.Add(fromFree)
+	if err != nil {
+		return err
+	}
+
+	journal.recordVestingAccount(account)
+	vestingAccounts[account] = va
+	return nil
+}
+
+// trackUndelegation records an unstake of a vesting account. Unlocked coins are returned
+// first, so the coins still locked keep being held back once they are back in the balance.
+func trackUndelegation(account string, amount Amount) error {
+	va, ok := vestingAccounts[account]
+	if !ok || va.Denom != NativeDenom {
+		return nil
+	}
+
+	toFree := minAmount(va.DelegatedFree, amount)
+	rest, err := amount.Sub(toFree)
+	if err != nil {
+		return err
+	}
+	toVesting := minAmount(va.DelegatedVesting, rest)
+
+	va.DelegatedFree, err = va.DelegatedFree.Sub(toFree)
+	if err != nil {
+		return err
+	}
+	va.DelegatedVesting, err = va.DelegatedVesting.Sub(toVesting)
+	if err != nil {
+		return err
+	}
+
+	journal.recordVestingAccount(account)
+	vestingAccounts[account] = va
+	return nil
+}
+
+func minAmount(a Amount, b Amount) Amount {
+	if b.LT(a) {
+		return b
+	}
+	return a
+}
+
+// spendBalance deducts an amount that must come out of the spendable balance of an account
+func spendBalance(account string, denom string, amount Amount, now int64) error {
+	if spendableBalance(account, denom, now).LT(amount) {
+		return errors.New("insufficient spendable balance")
+	}
+
+	return subBalance(account, denom, amount)
+}
+
+// vestingConsentHash returns the digest the recipient of a vesting account signs, the
+// signed payload of the transaction under the vesting consent domain tag
+func vestingConsentHash(tx Transaction) []byte {
+	hashed := transactionHash(tx)
+	if hashed == nil {
+		return nil
+	}
+
+	tagged := sha256.Sum256(append([]byte(vestingConsentDomain), hashed...))
+	return tagged[:]
+}
+
+// hasVestingConsent checks that the recipient of every vesting account a transaction creates
+// signed it. A vesting account restricts its owner, so nobody can turn another account into
+// one, or take its place with a dust schedule.
+func hasVestingConsent(tx Transaction) bool {
+	var recipients []string
+	if len(tx.Messages) == 0 && transactionType(tx) == "vesting_create" {
+		recipients = append(recipients, tx.To)
+	}
+	for _, msg := range tx.Messages {
+		if msg.Type == "vesting_create" {
+			recipients = append(recipients, msg.To)
+		}
+	}
+	if len(recipients) == 0 {
+		return true
+	}
+
+	hashed := vestingConsentHash(tx)
+	if hashed == nil {
+		return false
+	}
+
+	for _, recipient := range recipients {
+		pubKey := convertPublicKey(recipient)
+		if pubKey == nil || !verifySignature(pubKey, hashed, tx.ConsentSignatures[recipient]) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateVestingAccountTransaction locks the amount in a new vesting account for tx.To.
+// The recipient must have signed the transaction, see hasVestingConsent.
+func CreateVestingAccountTransaction(tx Transaction) error {
+	if tx.To == "" || tx.To == tx.From {
+		return errors.New("invalid vesting account")
+	}
+
+	if _, ok := vestingAccounts[tx.To]; ok {
+		return errors.New("vesting account already exists")
+	}
+
+	if tx.Amount.IsZero() {
+		return errors.New("invalid amount")
+	}
+
+	vestingType, _ := tx.Data["type"].(string)
+	start, _ := dataInt(tx.Data, "start")
+	end, _ := dataInt(tx.Data, "end")
+
+	va := VestingAccount{
+		Address:         tx.To,
+		Type:            vestingType,
+		Denom:           denomOrNative(tx.Denom),
+		OriginalVesting: tx.Amount,
+		StartTime:       start,
+		EndTime:         end,
+	}
+
+	switch vestingType {
+	case ContinuousVesting:
+		if start <= 0 || end <= start {
+			return errors.New("invalid vesting schedule")
+		}
+	case DelayedVesting:
+		if end <= 0 {
+			return errors.New("invalid vesting schedule")
+		}
+	case PeriodicVesting:
+		err := dataValue(tx.Data, "periods", &va.Periods)
+		if err != nil || start <= 0 || len(va.Periods) == 0 {
+			return errors.New("invalid vesting schedule")
+		}
+
+		// The periods must add up to the vesting amount
+		total := Amount{}
+		va.EndTime = start
+		for _, period := range va.Periods {
+			if period.Length < 0 {
+				return errors.New("invalid vesting period")
+			}
+			va.EndTime += period.Length
+
+			total, err = total.Add(period.Amount)
+			if err != nil {
+				return err
+			}
+		}
+
+		if total.Cmp(tx.Amount) != 0 {
+			return errors.New("vesting periods do not add up to the amount")
+		}
+	default:
+		return fmt.Errorf("unknown vesting type: %s", vestingType)
+	}
+
+	err := spendBalance(tx.From, tx.Denom, tx.Amount, tx.blockTime)
+	if err != nil {
+		return err
+	}
+
+	err = addBalance(tx.To, tx.Denom, tx.Amount)
+	if err != nil {
+		return err
+	}
+
+	journal.recordVestingAccount(tx.To)
+	vestingAccounts[tx.To] = va
+
+	emitEvent(tx, "vesting_create", map[string]string{
+		"account": tx.To,
+		"type":    vestingType,
+		"amount":  tx.Amount.String(),
+		"denom":   va.Denom,
+	})
+
+	return nil
+}
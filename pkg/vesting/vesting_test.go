@@ -0,0 +1,168 @@
+package main
+
+import "testing"
+
+func TestTrackDelegation(t *testing.T) {
+	const now = 1000
+
+	tests := []struct {
+		name      string
+		stake     int64
+		unstake   int64
+		vesting   int64 // DelegatedVesting afterwards
+		free      int64 // DelegatedFree afterwards
+		spendable int64
+	}{
+		// The account holds 150 coins of which 100 are locked
+		{name: "stake locked coins", stake: 80, vesting: 80, free: 0, spendable: 50},
+		{name: "stake all locked coins", stake: 100, vesting: 100, free: 0, spendable: 50},
+		{name: "stake beyond locked coins", stake: 120, vesting: 100, free: 20, spendable: 30},
+		{name: "unstake free coins first", stake: 120, unstake: 20, vesting: 100, free: 0, spendable: 50},
+		{name: "unstake locked coins last", stake: 120, unstake: 50, vesting: 70, free: 0, spendable: 50},
+	}
+
+	for _, tt := range tests {
+		resetState()
+		vestingAccounts["alice"] = VestingAccount{
+			Address:         "alice",
+			Type:            DelayedVesting,
+			Denom:           NativeDenom,
+			OriginalVesting: NewAmount(100),
+			EndTime:         now + 1,
+		}
+		addBalance("alice", NativeDenom, NewAmount(150))
+
+		// Staking moves coins out of the balance, unstaking moves them back
+		trackDelegation("alice", NewAmount(tt.stake), now)
+		subBalance("alice", NativeDenom, NewAmount(tt.stake))
+		if tt.unstake > 0 {
+			trackUndelegation("alice", NewAmount(tt.unstake))
+			addBalance("alice", NativeDenom, NewAmount(tt.unstake))
+		}
+
+		va := vestingAccounts["alice"]
+		if va.DelegatedVesting.Cmp(NewAmount(tt.vesting)) != 0 || va.DelegatedFree.Cmp(NewAmount(tt.free)) != 0 {
+			t.Errorf("%s: delegated vesting %s and free %s, want %d and %d", tt.name, va.DelegatedVesting, va.DelegatedFree, tt.vesting, tt.free)
+		}
+		if spendable := spendableBalance("alice", NativeDenom, now); spendable.Cmp(NewAmount(tt.spendable)) != 0 {
+			t.Errorf("%s: spendable balance = %s, want %d", tt.name, spendable, tt.spendable)
+		}
+	}
+}
+
+func TestVestedAmount(t *testing.T) {
+	continuous := VestingAccount{Type: ContinuousVesting, OriginalVesting: NewAmount(100), StartTime: 1000, EndTime: 2000}
+	delayed := VestingAccount{Type: DelayedVesting, OriginalVesting: NewAmount(100), EndTime: 2000}
+	periodic := VestingAccount{Type: PeriodicVesting, OriginalVesting: NewAmount(100), StartTime: 1000, Periods: []VestingPeriod{
+		{Length: 100, Amount: NewAmount(30)},
+		{Length: 100, Amount: NewAmount(70)},
+	}}
+
+	tests := []struct {
+		name string
+		va   VestingAccount
+		now  int64
+		want int64
+	}{
+		{"continuous before start", continuous, 900, 0},
+		{"continuous halfway", continuous, 1500, 50},
+		{"continuous after end", continuous, 2500, 100},
+		{"delayed before end", delayed, 1999, 0},
+		{"delayed at end", delayed, 2000, 100},
+		{"periodic inside first period", periodic, 1099, 0},
+		{"periodic after first period", periodic, 1100, 30},
+		{"periodic after last period", periodic, 1200, 100},
+	}
+
+	for _, tt := range tests {
+		if vested := tt.va.vestedAmount(tt.now); vested.Cmp(NewAmount(tt.want)) != 0 {
+			t.Errorf("%s: vested = %s, want %d", tt.name, vested, tt.want)
+		}
+	}
+}
+
+func TestCreateVestingAccountTransaction(t *testing.T) {
+	resetState()
+	addBalance("alice", NativeDenom, NewAmount(100))
+
+	tx := Transaction{
+		Type:      "vesting_create",
+		From:      "alice",
+		To:        "bob",
+		Amount:    NewAmount(60),
+		Data:      map[string]interface{}{"type": ContinuousVesting, "start": 1000, "end": 2000},
+		blockTime: 1000,
+	}
+	if err := CreateVestingAccountTransaction(tx); err != nil {
+		t.Fatalf("CreateVestingAccountTransaction() error = %v", err)
+	}
+
+	if balance := getBalance("alice", NativeDenom); balance.Cmp(NewAmount(40)) != 0 {
+		t.Errorf("sender balance = %s, want 40", balance)
+	}
+	va, ok := vestingAccounts["bob"]
+	if !ok || va.OriginalVesting.Cmp(NewAmount(60)) != 0 || va.EndTime != 2000 {
+		t.Fatalf("vesting account = %+v, %v", va, ok)
+	}
+	if spendable := spendableBalance("bob", NativeDenom, 1500); spendable.Cmp(NewAmount(30)) != 0 {
+		t.Errorf("spendable balance halfway = %s, want 30", spendable)
+	}
+	if err := TransferTransaction(Transaction{From: "bob", To: "carol", Amount: NewAmount(31), blockTime: 1500}); err == nil {
+		t.Error("transfer of locked coins error = nil")
+	}
+
+	if err := CreateVestingAccountTransaction(tx); err == nil {
+		t.Error("second vesting account for the same recipient error = nil")
+	}
+}
+
+func TestHasVestingConsent(t *testing.T) {
+	sender, recipient := NewWallet(), NewWallet()
+	to := publicKeyToString(recipient.PublicKey)
+
+	tx := Transaction{
+		Type:   "vesting_create",
+		From:   publicKeyToString(sender.PublicKey),
+		To:     to,
+		Amount: NewAmount(10),
+		Data:   map[string]interface{}{"type": DelayedVesting, "end": 2000},
+	}
+	consented, err := recipient.SignVestingConsent(tx)
+	if err != nil {
+		t.Fatalf("SignVestingConsent() error = %v", err)
+	}
+
+	// A signature made as sender must not count as consent
+	reused := tx
+	reused.ConsentSignatures = map[string]string{to: recipient.signTransaction(tx)}
+
+	// The consent covers the whole transaction, not only the recipient
+	changed := consented
+	changed.Amount = NewAmount(1)
+
+	inMessage := Transaction{From: tx.From, Messages: []Message{{Type: "vesting_create", To: to, Amount: NewAmount(10)}}}
+	inMessageConsented, err := recipient.SignVestingConsent(inMessage)
+	if err != nil {
+		t.Fatalf("SignVestingConsent() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		tx    Transaction
+		valid bool
+	}{
+		{"recipient consented", consented, true},
+		{"no consent", tx, false},
+		{"sender signature reused", reused, false},
+		{"changed after consent", changed, false},
+		{"message without consent", inMessage, false},
+		{"message with consent", inMessageConsented, true},
+		{"no vesting account", Transaction{From: tx.From, To: to, Amount: NewAmount(10)}, true},
+	}
+
+	for _, tt := range tests {
+		if hasVestingConsent(tt.tx) != tt.valid {
+			t.Errorf("%s: hasVestingConsent() = %v, want %v", tt.name, !tt.valid, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/perlin-network/life/compiler"
+	"github.com/perlin-network/life/exec"
+)
+
+// Contracts import the host ABI from this module
+const hostModule = "env"
+
+const contractPrefix = "contract:"
+
+// ErrOutOfGas is returned when a contract uses up its gas limit. The transaction is
+// reverted but the gas it used is still paid for.
+var ErrOutOfGas = errors.New("out of gas")
+
+// Maps contract addresses to their storage, each contract has its own key space
+var contractStorage = make(map[string]map[string][]byte)
+
+// A contractEnv gives a running contract access to the chain through the host ABI.
+// Strings and byte strings are passed as pointer and length pairs into the
+// contract's linear memory. Functions returning a string write it to a buffer
+// provided by the contract and return its full length, so the contract can
+// retry with a larger buffer. Every host call costs hostCallGas on top of the
+// gas of the instructions the contract executes.
+//
+//	input(ptr, cap) -> length of the call data as JSON
+//	storage_get(keyPtr, keyLen, valPtr, valCap) -> length, -1 if the key is not set
+//	storage_set(keyPtr, keyLen, valPtr, valLen) -> 0 on success, -1 if the contract cannot pay the storage deposit
+//	storage_delete(keyPtr, keyLen), refunds the storage deposit to the contract
+//	caller(ptr, cap) -> length
+//	self_address(ptr, cap) -> length
+//	balance(addrPtr, addrLen, denomPtr, denomLen, ptr, cap) -> length of the decimal amount
+//	transfer(toPtr, toLen, denomPtr, denomLen, amountPtr, amountLen) -> 0 on success, -1 on failure
+//	block_height() -> height of the block being executed
+//	block_time() -> Unix time of the block being executed
+//	emit_event(typePtr, typeLen, attrsPtr, attrsLen) with the attributes as a JSON object of strings
+//	call_contract(addrPtr, addrLen, fnPtr, fnLen, inputPtr, inputLen, denomPtr, denomLen, amountPtr, amountLen, gas)
+//		-> 0 on success, -1 if the call failed and was rolled back
+//	call_result() -> return value of the last successful call_contract
+//	abort(msgPtr, msgLen) stops the contract and reverts the transaction
+type contractEnv struct {
+	tx      Transaction // Transaction the contract runs in, its receipt collects the events
+	caller  string
+	address string
+	input   []byte // Call data of the contract
+	height  int
+	now     int64
+
+	gasLimit int
+	gasUsed  int
+
+	parent *contractEnv // Contract that called this one, nil for the outermost call
+	depth  int
+	result int64 // Return value of the last successful call_contract
+
+	view *queryState // State a query reads, nil when the contract runs against the live state
+}
+
+func newContractEnv(tx Transaction, caller string, address string, gasLimit int) *contractEnv {
+	return &contractEnv{
+		tx:       tx,
+		caller:   caller,
+		address:  address,
+		height:   tx.blockHeight,
+		now:      tx.blockTime,
+		gasLimit: gasLimit,
+	}
+}
+
+// remainingGas is the part of the gas limit of a transaction earlier contract calls did not use
+func remainingGas(tx Transaction) int {
+	if tx.receipt == nil {
+		return tx.GasLimit
+	}
+	return tx.GasLimit - tx.receipt.GasUsed
+}
+
+// contractAddress derives the address of a contract run from code shipped with a packet or proposal
+func contractAddress(code []byte) string {
+	hashed := sha256.Sum256(code)
+	return contractPrefix + hex.EncodeToString(hashed[:])
+}
+
+// runContract calls an exported function of the code with the host ABI bound to env
+func runContract(env *contractEnv, code []byte, function string, args ...int64) (int64, error) {
+	// A zero gas limit would let the contract run unmetered
+	if env.gasLimit <= 0 {
+		return 0, ErrOutOfGas
+	}
+
+	compiled, err := acquireContract(code)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseContract(compiled)
+
+	vm := compiled.bind(env)
+
+	entryID, ok := vm.GetFunctionExport(function)
+	if !ok {
+		return 0, fmt.Errorf("contract does not export %s", function)
+	}
+
+	// Host functions report errors by panicking, Run turns them into an error
+	ret, err := vm.Run(entryID, args...)
+
+	env.gasUsed = int(vm.Gas)
+	if vm.GasLimitExceeded {
+		env.gasUsed = env.gasLimit
+		err = ErrOutOfGas
+	}
+
+	// Gas of nested calls is charged to their caller instead
+	if env.parent == nil && env.tx.receipt != nil {
+		env.tx.receipt.GasUsed += env.gasUsed
+	}
+
+	return ret, err
+}
+
+// A contractHost resolves the imports of a module to the host ABI. The functions it
+// returns dispatch to the environment of the call being run, so an instantiated
+// module can be reused for calls in different environments.
+type contractHost struct {
+	env *contractEnv
+}
+
+func newContractVM(host *contractHost, code []byte) (vm *exec.VirtualMachine, err error) {
+	// Imports are resolved while the module is instantiated, unknown ones panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not instantiate contract: %v", r)
+		}
+	}()
+
+	return exec.NewVirtualMachine(code, contractVMConfig(), host, contractGasPolicy())
+}
+
+// contractVMConfig returns the limits contracts currently run under. The gas limit is set for every call.
+func contractVMConfig() exec.VMConfig {
+	return exec.VMConfig{
+		ReturnOnGasLimitExceeded: true,
+		DisableFloatingPoint:     true,
+		MaxMemoryPages:           GlobalConfig["contractMemoryPages"],
+		MaxCallStackDepth:        GlobalConfig["contractCallDepth"],
+		MaxValueSlots:            GlobalConfig["contractValueSlots"],
+	}
+}
+
+func contractGasPolicy() compiler.GasPolicy {
+	return &compiler.SimpleGasPolicy{GasPerInstruction: 1}
+}
+
+// useGas charges gas for host work and stops the contract once its gas limit is used up
+func (env *contractEnv) useGas(vm *exec.VirtualMachine, gas int) {
+	if !vm.AddAndCheckGas(uint64(gas)) {
+		vm.GasLimitExceeded = true
+		panic(ErrOutOfGas)
+	}
+}
+
+func (host *contractHost) ResolveFunc(module, field string) exec.FunctionImport {
+	if module != hostModule {
+		panic(fmt.Errorf("unknown import module: %s", module))
+	}
+
+	if !isHostFunction(field) {
+		panic(fmt.Errorf("unknown host function: %s", field))
+	}
+
+	return func(vm *exec.VirtualMachine) int64 {
+		env := host.env
+		env.useGas(vm, GlobalConfig["hostCallGas"])
+		return env.hostFunction(field)(vm)
+	}
+}
+
+// hostFunction returns the host function an import names, nil if there is none
+func (env *contractEnv) hostFunction(field string) exec.FunctionImport {
+	switch field {
+	case "input":
+		return func(vm *exec.VirtualMachine) int64 {
+			return writeBytes(vm, 0, env.input)
+		}
+	case "storage_get":
+		return env.storageGet
+	case "storage_set":
+		return env.storageSet
+	case "storage_delete":
+		return env.storageDelete
+	case "caller":
+		return func(vm *exec.VirtualMachine) int64 {
+			return writeString(vm, 0, env.caller)
+		}
+	case "self_address":
+		return func(vm *exec.VirtualMachine) int64 {
+			return writeString(vm, 0, env.address)
+		}
+	case "balance":
+		return env.balance
+	case "transfer":
+		return env.transfer
+	case "block_height":
+		return func(vm *exec.VirtualMachine) int64 {
+			return int64(env.height)
+		}
+	case "block_time":
+		return func(vm *exec.VirtualMachine) int64 {
+			return env.now
+		}
+	case "emit_event":
+		return env.emitEvent
+	case "call_contract":
+		return env.callContract
+	case "call_result":
+		return func(vm *exec.VirtualMachine) int64 {
+			return env.result
+		}
+	case "abort":
+		return func(vm *exec.VirtualMachine) int64 {
+			panic(fmt.Errorf("contract aborted: %s", readString(vm, 0)))
+		}
+	default:
+		return nil
+	}
+}
+
+func isHostFunction(field string) bool {
+	return (&contractEnv{}).hostFunction(field) != nil
+}
+
+func (host *contractHost) ResolveGlobal(module, field string) int64 {
+	panic(fmt.Errorf("unknown global: %s.%s", module, field))
+}
+
+func (env *contractEnv) storageGet(vm *exec.VirtualMachine) int64 {
+	key := readString(vm, 0)
+
+	value, ok := env.readStorage(key)
+	if !ok {
+		return -1
+	}
+
+	return writeBytes(vm, 2, value)
+}
+
+func (env *contractEnv) storageSet(vm *exec.VirtualMachine) int64 {
+	env.checkWritable()
+	key := readString(vm, 0)
+	value := append([]byte(nil), readBytes(vm, 2)...)
+	env.useGas(vm, (len(key)+len(value))*GlobalConfig["storageByteGas"])
+
+	journal.recordStorage(env.address, key)
+	err := lockStorageDeposit(env.address, key, value)
+	if err != nil {
+		return -1
+	}
+
+	if contractStorage[env.address] == nil {
+		contractStorage[env.address] = make(map[string][]byte)
+	}
+	contractStorage[env.address][key] = value
+
+	return 0
+}
+
+func (env *contractEnv) storageDelete(vm *exec.VirtualMachine) int64 {
+	env.checkWritable()
+	key := readString(vm, 0)
+
+	journal.recordStorage(env.address, key)
+	err := refundStorageDeposit(env.address, key)
+	if err != nil {
+		panic(err)
+	}
+
+	delete(contractStorage[env.address], key)
+	if len(contractStorage[env.address]) == 0 {
+		delete(contractStorage, env.address)
+	}
+
+	return 0
+}
+
+func (env *contractEnv) balance(vm *exec.VirtualMachine) int64 {
+	account := readString(vm, 0)
+	denom := readString(vm, 2)
+
+	return writeString(vm, 4, env.readBalance(account, denomOrNative(denom)).String())
+}
+
+// transfer moves funds out of the contract's own account
+func (env *contractEnv) transfer(vm *exec.VirtualMachine) int64 {
+	env.checkWritable()
+	to := readString(vm, 0)
+	denom := denomOrNative(readString(vm, 2))
+
+	amount, err := ParseAmount(readString(vm, 4))
+	if err != nil || to == "" || !isKnownDenom(denom) {
+		return -1
+	}
+
+	err = subBalance(env.address, denom, amount)
+	if err != nil {
+		return -1
+	}
+
+	err = addBalance(to, denom, amount)
+	if err != nil {
+		// Undo the debit so the contract sees a failed transfer and nothing else
+		addBalance(env.address, denom, amount)
+		return -1
+	}
+
+	emitEvent(env.tx, "transfer", map[string]string{
+		"from":   env.address,
+		"to":     to,
+		"amount": amount.String(),
+		"denom":  denom,
+	})
+
+	return 0
+}
+
+func (env *contractEnv) emitEvent(vm *exec.VirtualMachine) int64 {
+	eventType := readString(vm, 0)
+
+	attributes := make(map[string]string)
+	err := json.Unmarshal(readBytes(vm, 2), &attributes)
+	if err != nil || eventType == "" {
+		panic(errors.New("invalid contract event"))
+	}
+
+	// Contract events always name the contract that emitted them
+	attributes["contract"] = env.address
+	emitEvent(env.tx, eventType, attributes)
+
+	return 0
+}
+
+// callContract calls a function of another contract, sending it funds from this contract.
+// The callee gets the gas the caller forwards, all of the remaining gas when it forwards 0,
+// and the gas it uses is charged to the caller. If the callee fails, its state changes and
+// events are rolled back and the caller gets to handle the failure.
+func (env *contractEnv) callContract(vm *exec.VirtualMachine) int64 {
+	address := readString(vm, 0)
+	function := readString(vm, 2)
+	input := append([]byte(nil), readBytes(vm, 4)...)
+	denom := denomOrNative(readString(vm, 6))
+	gas := int(vm.GetCurrentFrame().Locals[10])
+
+	var amount Amount
+	if value := readString(vm, 8); value != "" {
+		parsed, err := ParseAmount(value)
+		if err != nil {
+			return -1
+		}
+		amount = parsed
+	}
+
+	instance, err := env.readContract(address)
+	if err != nil || env.depth >= GlobalConfig["contractNestingDepth"] {
+		return -1
+	}
+
+	// A contract running further up the call stack can only be entered again if it allows it
+	if env.isActive(instance.Address) && !instance.Reentrant {
+		return -1
+	}
+
+	available := env.gasLimit - int(vm.Gas)
+	if gas <= 0 || gas > available {
+		gas = available
+	}
+
+	events := 0
+	if env.tx.receipt != nil {
+		events = len(env.tx.receipt.Events)
+	}
+
+	callee := &contractEnv{
+		tx:       env.tx,
+		caller:   env.address,
+		address:  instance.Address,
+		input:    input,
+		height:   env.height,
+		now:      env.now,
+		gasLimit: gas,
+		parent:   env,
+		depth:    env.depth + 1,
+		view:     env.view,
+	}
+
+	// The call runs in the journal of the transaction, a failure undoes only its own writes
+	var ret int64
+	err = journaled(false, func() error {
+		err := env.sendValue(instance.Address, denom, amount)
+		if err != nil {
+			return err
+		}
+
+		ret, err = runContract(callee, env.readCode(instance.CodeHash), function)
+		return err
+	})
+
+	if err != nil {
+		if env.tx.receipt != nil {
+			env.tx.receipt.Events = env.tx.receipt.Events[:events]
+		}
+	}
+
+	env.useGas(vm, callee.gasUsed)
+	if err != nil {
+		return -1
+	}
+
+	env.result = ret
+	return 0
+}
+
+// isActive reports whether a contract is running in this call or further up the call stack
+func (env *contractEnv) isActive(address string) bool {
+	for e := env; e != nil; e = e.parent {
+		if e.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// sendValue moves funds from the running contract to the contract it calls
+func (env *contractEnv) sendValue(to string, denom string, amount Amount) error {
+	if amount.IsZero() {
+		return nil
+	}
+	env.checkWritable()
+
+	err := subBalance(env.address, denom, amount)
+	if err != nil {
+		return err
+	}
+
+	return addBalance(to, denom, amount)
+}
+
+// readBytes returns the memory slice described by the pointer and length parameters at index i
+func readBytes(vm *exec.VirtualMachine, i int) []byte {
+	locals := vm.GetCurrentFrame().Locals
+	ptr, length := locals[i], locals[i+1]
+
+	if ptr < 0 || length < 0 || ptr+length > int64(len(vm.Memory)) {
+		panic(errors.New("memory access out of bounds"))
+	}
+
+	return vm.Memory[ptr : ptr+length]
+}
+
+func readString(vm *exec.VirtualMachine, i int) string {
+	return string(readBytes(vm, i))
+}
+
+// writeBytes copies as much of the value as fits into the buffer described by the
+// pointer and capacity parameters at index i and returns the full length of the value
+func writeBytes(vm *exec.VirtualMachine, i int, value []byte) int64 {
+	buffer := readBytes(vm, i)
+	copy(buffer, value)
+
+	return int64(len(value))
+}
+
+func writeString(vm *exec.VirtualMachine, i int, value string) int64 {
+	return writeBytes(vm, i, []byte(value))
+}
+
+// ContractStorage returns a value a contract has stored, for clients inspecting contract state
+func ContractStorage(address string, key string) ([]byte, error) {
+	value, ok := contractStorage[address][key]
+	if !ok {
+		return nil, fmt.Errorf("key not found in contract storage: %q", key)
+	}
+	return value, nil
+}
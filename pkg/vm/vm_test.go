@@ -0,0 +1,436 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Contract tests persist compiled modules outside the source tree
+func init() {
+	DataDir = filepath.Join(os.TempDir(), "kiwi-contract-tests")
+}
+
+// A wasmFunc is a function of a test module. Unless locals says otherwise, it takes
+// i32 parameters and returns an i32.
+type wasmFunc struct {
+	name   string // Host function for imports, as module.field outside the host module, export name otherwise
+	params int
+	locals []byte // Value types of the locals
+	body   []byte // Instructions without the final end, nil for imports
+}
+
+// A wasmModule assembles a contract module by hand. The imports come first in the
+// function index space and the data is placed at offset 0 of the memory.
+type wasmModule struct {
+	imports []wasmFunc
+	funcs   []wasmFunc
+	data    string
+	pages   int // Initial memory pages, 1 when zero
+}
+
+const (
+	wasmI32  = 0x7f
+	wasmF64  = 0x7c
+	wasmDrop = 0x1a
+)
+
+func (m wasmModule) code() []byte {
+	var types, imports, funcs, exports, bodies [][]byte
+	for i, f := range append(append([]wasmFunc(nil), m.imports...), m.funcs...) {
+		signature := append([]byte{0x60}, uleb(f.params)...)
+		for p := 0; p < f.params; p++ {
+			signature = append(signature, wasmI32)
+		}
+		types = append(types, append(signature, 1, wasmI32))
+
+		if i < len(m.imports) {
+			module, field := hostModule, f.name
+			if dot := strings.Index(f.name, "."); dot >= 0 {
+				module, field = f.name[:dot], f.name[dot+1:]
+			}
+			entry := append(wasmName(module), wasmName(field)...)
+			imports = append(imports, append(append(entry, 0x00), uleb(i)...))
+			continue
+		}
+
+		funcs = append(funcs, uleb(i))
+		exports = append(exports, append(append(wasmName(f.name), 0x00), uleb(i)...))
+
+		body := uleb(len(f.locals))
+		for _, local := range f.locals {
+			body = append(body, 1, local)
+		}
+		body = append(append(body, f.body...), 0x0b)
+		bodies = append(bodies, append(uleb(len(body)), body...))
+	}
+
+	pages := m.pages
+	if pages == 0 {
+		pages = 1
+	}
+
+	code := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	code = append(code, wasmSection(1, types)...)
+	if len(imports) > 0 {
+		code = append(code, wasmSection(2, imports)...)
+	}
+	code = append(code, wasmSection(3, funcs)...)
+	code = append(code, wasmSection(5, [][]byte{append([]byte{0x00}, uleb(pages)...)})...)
+	code = append(code, wasmSection(7, exports)...)
+	code = append(code, wasmSection(10, bodies)...)
+	if m.data != "" {
+		code = append(code, wasmSection(11, [][]byte{append([]byte{0x00, 0x41, 0x00, 0x0b}, wasmName(m.data)...)})...)
+	}
+	return code
+}
+
+func wasmSection(id byte, entries [][]byte) []byte {
+	payload := uleb(len(entries))
+	for _, entry := range entries {
+		payload = append(payload, entry...)
+	}
+	return append(append([]byte{id}, uleb(len(payload))...), payload...)
+}
+
+func wasmName(s string) []byte {
+	return append(uleb(len(s)), s...)
+}
+
+func uleb(n int) []byte {
+	var encoded []byte
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(encoded, b)
+		}
+		encoded = append(encoded, b|0x80)
+	}
+}
+
+func sleb(n int64) []byte {
+	var encoded []byte
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && b&0x40 == 0) || (n == -1 && b&0x40 != 0) {
+			return append(encoded, b)
+		}
+		encoded = append(encoded, b|0x80)
+	}
+}
+
+func i32Const(n int64) []byte {
+	return append([]byte{0x41}, sleb(n)...)
+}
+
+// wasmCall calls function f with constant arguments
+func wasmCall(f int, args ...int64) []byte {
+	var code []byte
+	for _, arg := range args {
+		code = append(code, i32Const(arg)...)
+	}
+	return append(append(code, 0x10), uleb(f)...)
+}
+
+func instructions(parts ...[]byte) []byte {
+	var code []byte
+	for _, part := range parts {
+		code = append(code, part...)
+	}
+	return code
+}
+
+// deployTestContract stores the code of a module and instantiates it at the address
+func deployTestContract(address string, m wasmModule) {
+	code := m.code()
+	hash := codeHash(code)
+	contractCode[hash] = code
+	contracts[address] = ContractInstance{Address: address, CodeHash: hash}
+}
+
+// callTestContract calls a function of a deployed contract the way a transaction does
+func callTestContract(t *testing.T, address string, function string, gasLimit int) (int64, *Receipt, error) {
+	t.Helper()
+
+	receipt := &Receipt{}
+	tx := Transaction{
+		Type:        "contract",
+		From:        "alice",
+		Contract:    &SmartContract{Address: address, Function: function},
+		GasLimit:    gasLimit,
+		receipt:     receipt,
+		blockHeight: 42,
+		blockTime:   1000,
+	}
+
+	var ret int64
+	err := journaled(false, func() error {
+		var err error
+		ret, err = callContract(tx, contracts[address], gasLimit)
+		return err
+	})
+	return ret, receipt, err
+}
+
+// Imports of the host ABI test contract, in function index order
+const (
+	abiStorageSet = iota
+	abiStorageGet
+	abiStorageDelete
+	abiBlockHeight
+	abiEmitEvent
+	abiTransfer
+)
+
+func hostABIContract() wasmModule {
+	// key at 0, value at 3, attributes at 8, event type at 17, recipient at 21, amount at 24, buffer at 64
+	return wasmModule{
+		imports: []wasmFunc{
+			{name: "storage_set", params: 4},
+			{name: "storage_get", params: 4},
+			{name: "storage_delete", params: 2},
+			{name: "block_height"},
+			{name: "emit_event", params: 4},
+			{name: "transfer", params: 6},
+		},
+		funcs: []wasmFunc{
+			{name: "store", body: instructions(wasmCall(abiStorageSet, 0, 3, 3, 5), []byte{wasmDrop}, wasmCall(abiStorageGet, 0, 3, 64, 16))},
+			{name: "load", body: wasmCall(abiStorageGet, 0, 3, 64, 16)},
+			{name: "delete", body: instructions(wasmCall(abiStorageDelete, 0, 3), []byte{wasmDrop}, i32Const(0))},
+			{name: "height", body: wasmCall(abiBlockHeight)},
+			{name: "emit", body: instructions(wasmCall(abiEmitEvent, 17, 4, 8, 9), []byte{wasmDrop}, i32Const(0))},
+			{name: "pay", body: wasmCall(abiTransfer, 21, 3, 0, 0, 24, 1)},
+			{name: "overpay", body: wasmCall(abiTransfer, 21, 3, 0, 0, 25, 3)},
+			{name: "out_of_bounds", body: wasmCall(abiStorageSet, 65530, 100, 0, 1)},
+		},
+		data: `keyvalue{"a":"b"}pingbob7999`,
+	}
+}
+
+func TestHostABI(t *testing.T) {
+	resetState()
+	deployTestContract("contract:abi", hostABIContract())
+	addBalance("contract:abi", NativeDenom, NewAmount(100))
+
+	call := func(function string) (int64, *Receipt) {
+		ret, receipt, err := callTestContract(t, "contract:abi", function, 100000)
+		if err != nil {
+			t.Fatalf("%s: error = %v", function, err)
+		}
+		return ret, receipt
+	}
+
+	if ret, _ := call("store"); ret != 5 {
+		t.Errorf("store returned %d, want the length of the stored value", ret)
+	}
+	if value, err := ContractStorage("contract:abi", "key"); err != nil || string(value) != "value" {
+		t.Errorf("storage = %q, %v, want \"value\"", value, err)
+	}
+
+	if ret, _ := call("height"); ret != 42 {
+		t.Errorf("block_height() = %d, want the height of the block", ret)
+	}
+
+	_, receipt := call("emit")
+	if len(receipt.Events) != 1 || receipt.Events[0].Type != "ping" || receipt.Events[0].Attributes["a"] != "b" || receipt.Events[0].Attributes["contract"] != "contract:abi" {
+		t.Errorf("events = %v, want a ping event naming the contract", receipt.Events)
+	}
+
+	before := getBalance("contract:abi", NativeDenom)
+	if ret, _ := call("pay"); ret != 0 {
+		t.Errorf("transfer() = %d, want 0", ret)
+	}
+	if balance := getBalance("bob", NativeDenom); balance.Cmp(NewAmount(7)) != 0 {
+		t.Errorf("bob balance = %s, want 7", balance)
+	}
+	if ret, _ := call("overpay"); int32(ret) != -1 {
+		t.Errorf("transfer() beyond the balance = %d, want -1", ret)
+	}
+	if balance, _ := before.Sub(NewAmount(7)); getBalance("contract:abi", NativeDenom).Cmp(balance) != 0 {
+		t.Errorf("contract balance = %s, want %s", getBalance("contract:abi", NativeDenom), balance)
+	}
+
+	call("delete")
+	if ret, _ := call("load"); int32(ret) != -1 {
+		t.Errorf("storage_get() after delete = %d, want -1", ret)
+	}
+
+	if _, _, err := callTestContract(t, "contract:abi", "out_of_bounds", 100000); err == nil {
+		t.Error("out of bounds memory access error = nil")
+	}
+}
+
+func TestIsHostFunction(t *testing.T) {
+	for _, field := range []string{"input", "storage_get", "transfer", "call_contract", "abort"} {
+		if !isHostFunction(field) {
+			t.Errorf("isHostFunction(%q) = false", field)
+		}
+	}
+	for _, field := range []string{"", "exit", "random"} {
+		if isHostFunction(field) {
+			t.Errorf("isHostFunction(%q) = true", field)
+		}
+	}
+}
+
+func TestContractGas(t *testing.T) {
+	resetState()
+	deployTestContract("contract:abi", hostABIContract())
+	addBalance("contract:abi", NativeDenom, NewAmount(100))
+
+	// Every host call costs hostCallGas, so a smaller limit cannot make one
+	_, receipt, err := callTestContract(t, "contract:abi", "height", GlobalConfig["hostCallGas"]-1)
+	if err != ErrOutOfGas {
+		t.Fatalf("error = %v, want ErrOutOfGas", err)
+	}
+	if receipt.GasUsed != GlobalConfig["hostCallGas"]-1 {
+		t.Errorf("gas used = %d, want the whole gas limit", receipt.GasUsed)
+	}
+
+	if _, _, err := callTestContract(t, "contract:abi", "height", 0); err != ErrOutOfGas {
+		t.Errorf("zero gas limit error = %v, want ErrOutOfGas", err)
+	}
+
+	// Writing storage costs storageByteGas per byte on top of the host call
+	_, receipt, err = callTestContract(t, "contract:abi", "store", 100000)
+	if err != nil {
+		t.Fatalf("store error = %v", err)
+	}
+	if minimum := 2*GlobalConfig["hostCallGas"] + 8*GlobalConfig["storageByteGas"]; receipt.GasUsed < minimum {
+		t.Errorf("gas used = %d, want at least %d", receipt.GasUsed, minimum)
+	}
+
+	// A storage write that runs out of gas leaves no trace
+	resetState()
+	deployTestContract("contract:abi", hostABIContract())
+	addBalance("contract:abi", NativeDenom, NewAmount(100))
+	if _, _, err := callTestContract(t, "contract:abi", "store", GlobalConfig["hostCallGas"]+10); err != ErrOutOfGas {
+		t.Fatalf("error = %v, want ErrOutOfGas", err)
+	}
+	if _, err := ContractStorage("contract:abi", "key"); err == nil {
+		t.Error("storage written by a call that ran out of gas")
+	}
+}
+
+// callerContract calls the contract at contract:b, sending it 7 coins, and then itself
+func callerContract() wasmModule {
+	const (
+		storageSet = iota
+		callContract
+		callResult
+		abort
+	)
+
+	// key and value at 0, callee at 2, its functions at 12 and 14, amount at 18, own address at 19, main at 29
+	call := func(addrPtr int64, fnPtr int64, fnLen int64, amountLen int64) []byte {
+		return wasmCall(callContract, addrPtr, 10, fnPtr, fnLen, 0, 0, 0, 0, 18, amountLen, 0)
+	}
+	return wasmModule{
+		imports: []wasmFunc{
+			{name: "storage_set", params: 4},
+			{name: "call_contract", params: 11},
+			{name: "call_result"},
+			{name: "abort", params: 2},
+		},
+		funcs: []wasmFunc{
+			{name: "main", body: i32Const(0)},
+			{name: "call_ok", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, call(2, 12, 2, 1), []byte{wasmDrop}, wasmCall(callResult))},
+			{name: "call_fail", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, call(2, 14, 4, 1))},
+			{name: "call_self", body: call(19, 29, 4, 0)},
+			{name: "call_ok_then_abort", body: instructions(call(2, 12, 2, 1), []byte{wasmDrop}, wasmCall(abort, 14, 4))},
+		},
+		data: "axcontract:bokfail7contract:amain",
+	}
+}
+
+// calleeContract writes its storage and returns 42 from ok, or aborts after writing from fail
+func calleeContract() wasmModule {
+	const (
+		storageSet = iota
+		abort
+	)
+
+	return wasmModule{
+		imports: []wasmFunc{
+			{name: "storage_set", params: 4},
+			{name: "abort", params: 2},
+		},
+		funcs: []wasmFunc{
+			{name: "ok", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, i32Const(42))},
+			{name: "fail", body: instructions(wasmCall(storageSet, 0, 1, 1, 1), []byte{wasmDrop}, wasmCall(abort, 2, 4))},
+		},
+		data: "bxfail",
+	}
+}
+
+func TestNestedContractCalls(t *testing.T) {
+	setup := func() {
+		resetState()
+		deployTestContract("contract:a", callerContract())
+		deployTestContract("contract:b", calleeContract())
+		addBalance("contract:a", NativeDenom, NewAmount(100))
+	}
+	stored := func(address string, key string) bool {
+		_, err := ContractStorage(address, key)
+		return err == nil
+	}
+
+	// Each entry of one key and a one byte value locks a deposit of 2
+	setup()
+	ret, _, err := callTestContract(t, "contract:a", "call_ok", 100000)
+	if err != nil || ret != 42 {
+		t.Fatalf("call_ok = %d, %v, want the result of the callee", ret, err)
+	}
+	if !stored("contract:a", "a") || !stored("contract:b", "b") {
+		t.Error("storage of a successful nested call was not kept")
+	}
+	if balance := getBalance("contract:b", NativeDenom); balance.Cmp(NewAmount(5)) != 0 {
+		t.Errorf("callee balance = %s, want 5", balance)
+	}
+	if balance := getBalance("contract:a", NativeDenom); balance.Cmp(NewAmount(91)) != 0 {
+		t.Errorf("caller balance = %s, want 91", balance)
+	}
+
+	// A failed nested call only undoes its own writes and the value sent with it
+	setup()
+	ret, receipt, err := callTestContract(t, "contract:a", "call_fail", 100000)
+	if err != nil || int32(ret) != -1 {
+		t.Fatalf("call_fail = %d, %v, want the caller to see -1", ret, err)
+	}
+	if !stored("contract:a", "a") {
+		t.Error("caller storage was rolled back with the callee")
+	}
+	if stored("contract:b", "b") {
+		t.Error("storage of the failed callee was kept")
+	}
+	if balance := getBalance("contract:b", NativeDenom); !balance.IsZero() {
+		t.Errorf("callee balance = %s, want the value sent back", balance)
+	}
+	if balance := getBalance("contract:a", NativeDenom); balance.Cmp(NewAmount(98)) != 0 {
+		t.Errorf("caller balance = %s, want 98", balance)
+	}
+	if receipt.GasUsed <= 3*GlobalConfig["hostCallGas"] {
+		t.Errorf("gas used = %d, want the gas of the failed callee charged", receipt.GasUsed)
+	}
+
+	// A contract cannot be entered again unless it allows it
+	setup()
+	if ret, _, err := callTestContract(t, "contract:a", "call_self", 100000); err != nil || int32(ret) != -1 {
+		t.Errorf("call_self = %d, %v, want -1", ret, err)
+	}
+
+	// A failing caller undoes the nested calls that succeeded
+	setup()
+	if _, _, err := callTestContract(t, "contract:a", "call_ok_then_abort", 100000); err == nil {
+		t.Fatal("call_ok_then_abort error = nil")
+	}
+	if stored("contract:b", "b") || !getBalance("contract:b", NativeDenom).IsZero() {
+		t.Error("nested call of a failed transaction was kept")
+	}
+	if balance := getBalance("contract:a", NativeDenom); balance.Cmp(NewAmount(100)) != 0 {
+		t.Errorf("caller balance = %s, want 100", balance)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/rand"
 	"log"
+	"errors"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"crypto/x509"
 )
@@ -19,11 +22,14 @@ func NewWallet() *Wallet {
 	return &Wallet{PrivateKey: privKey, PublicKey: pubKey}
 }
 
-func (w *Wallet) CreateTransaction(to string, amount int) Transaction {
+func (w *Wallet) CreateTransaction(to string, amount Amount) Transaction {
+	from := publicKeyToString(w.PublicKey)
 	tx := Transaction{
-		From:   publicKeyToString(w.PublicKey),
-		To:     to,
-		Amount: amount,
+		From:         from,
+		To:           to,
+		Amount:       amount,
+		Nonce:        nextNonce(from),
+		ExpiryHeight: defaultExpiryHeight(),
 	}
 
 	tx.Signature = w.signTransaction(tx)
@@ -31,17 +37,69 @@ func (w *Wallet) CreateTransaction(to string, amount int) Transaction {
 	return tx
 }
 
+// CreateSponsoredTransaction creates a transaction whose fee is paid by another account.
+// The fee payer either co-signs it with SignAsFeePayer or has granted the wallet a fee allowance.
+func (w *Wallet) CreateSponsoredTransaction(to string, amount Amount, fee Amount, feePayer string) Transaction {
+	from := publicKeyToString(w.PublicKey)
+	tx := Transaction{
+		From:         from,
+		To:           to,
+		Amount:       amount,
+		Fee:          fee,
+		Nonce:        nextNonce(from),
+		ExpiryHeight: defaultExpiryHeight(),
+		FeePayer:     feePayer,
+	}
+
+	tx.Signature = w.signTransaction(tx)
+
+	return tx
+}
+
+// SignAsFeePayer adds the wallet's signature agreeing to pay the fee of a transaction
+func (w *Wallet) SignAsFeePayer(tx Transaction) (Transaction, error) {
+	if tx.FeePayer != publicKeyToString(w.PublicKey) {
+		return tx, errors.New("wallet is not the fee payer of the transaction")
+	}
+
+	tx.FeePayerSignature = w.signHash(feePayerHash(tx))
+	if tx.FeePayerSignature == "" {
+		return tx, errors.New("could not sign transaction")
+	}
+
+	return tx, nil
+}
+
+// SignVestingConsent adds the wallet's signature agreeing to become the vesting account
+// a transaction creates
+func (w *Wallet) SignVestingConsent(tx Transaction) (Transaction, error) {
+	recipient := publicKeyToString(w.PublicKey)
+
+	signature := w.signHash(vestingConsentHash(tx))
+	if signature == "" {
+		return tx, errors.New("could not sign transaction")
+	}
+
+	// Copy the signatures so the caller's transaction is left untouched
+	signatures := make(map[string]string)
+	for key, sig := range tx.ConsentSignatures {
+		signatures[key] = sig
+	}
+	signatures[recipient] = signature
+	tx.ConsentSignatures = signatures
+
+	return tx, nil
+}
+
 func (w *Wallet) signTransaction(tx Transaction) string {
-	// Create a new hash
-	hash := sha256.New()
+	// Hash the signed payload of the transaction
+	return w.signHash(transactionHash(tx))
+}
 
-	// Write the transaction data to the hash
-	_, err := hash.Write([]byte(tx.Data)) // assuming tx.Data contains the transaction data
-	if err != nil {
-		log.Println(err)
+func (w *Wallet) signHash(hashed []byte) string {
+	if hashed == nil {
 		return ""
 	}
-	hashed := hash.Sum(nil)
 
 	// Sign the hash with the private key
 	signature, err := rsa.SignPKCS1v15(rand.Reader, w.PrivateKey, crypto.SHA256, hashed[:])
@@ -53,6 +111,99 @@ func (w *Wallet) signTransaction(tx Transaction) string {
 	return hex.EncodeToString(signature)
 }
 
+// NewMultisigTransaction creates an unsigned transaction spending from a multisig account.
+// The co-signers add their signatures with SignMultisigTransaction, possibly offline,
+// and the partial transactions are merged with CombineSignatures before broadcast.
+func NewMultisigTransaction(account *MultisigAccount, to string, amount Amount) Transaction {
+	return Transaction{
+		From:         account.Address(),
+		To:           to,
+		Amount:       amount,
+		Signatures:   make(map[string]string),
+		Multisig:     account,
+		Nonce:        nextNonce(account.Address()),
+		ExpiryHeight: defaultExpiryHeight(),
+	}
+}
+
+func defaultExpiryHeight() int {
+	return currentHeight() + GlobalConfig["txTTL"]
+}
+
+// SignMultisigTransaction adds the wallet's partial signature to a multisig transaction.
+func (w *Wallet) SignMultisigTransaction(tx Transaction) (Transaction, error) {
+	if tx.Multisig == nil {
+		return tx, errors.New("transaction is not a multisig transaction")
+	}
+
+	pubKey := publicKeyToString(w.PublicKey)
+	if !tx.Multisig.HasKey(pubKey) {
+		return tx, errors.New("wallet is not a signer of the multisig account")
+	}
+
+	signature := w.signTransaction(tx)
+	if signature == "" {
+		return tx, errors.New("could not sign transaction")
+	}
+
+	// Copy the signatures so the caller's partial transaction is left untouched
+	signatures := make(map[string]string)
+	for key, sig := range tx.Signatures {
+		signatures[key] = sig
+	}
+	signatures[pubKey] = signature
+	tx.Signatures = signatures
+
+	return tx, nil
+}
+
+// CombineSignatures merges partially signed copies of the same multisig transaction.
+func CombineSignatures(partials ...Transaction) (Transaction, error) {
+	if len(partials) == 0 {
+		return Transaction{}, errors.New("no transactions to combine")
+	}
+
+	combined := partials[0]
+	hashed := hex.EncodeToString(transactionHash(combined))
+	signatures := make(map[string]string)
+
+	for _, partial := range partials {
+		if hex.EncodeToString(transactionHash(partial)) != hashed {
+			return Transaction{}, errors.New("partial transactions do not match")
+		}
+
+		for key, sig := range partial.Signatures {
+			signatures[key] = sig
+		}
+	}
+
+	combined.Signatures = signatures
+	return combined, nil
+}
+
+// ExportTransaction encodes a transaction so it can be carried to an offline signer.
+func ExportTransaction(tx Transaction) (string, error) {
+	encoded, err := json.Marshal(tx)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(encoded), nil
+}
+
+// ImportTransaction decodes a transaction produced by ExportTransaction.
+func ImportTransaction(data string) (Transaction, error) {
+	var tx Transaction
+
+	encoded, err := hex.DecodeString(data)
+	if err != nil {
+		return tx, err
+	}
+
+	err = json.Unmarshal(encoded, &tx)
+	return tx, err
+}
+
 func generateKeyPair() (*rsa.PrivateKey, *rsa.PublicKey) {
 	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/perlin-network/life/compiler"
+)
+
+// validateContractCode checks that code can be deployed as a contract. Contracts must
+// run the same on every node, so floating-point instructions and imports other than the
+// host ABI are rejected, and the module must fit the size limits of the chain.
+// The error says precisely why the code was rejected and ends up in the deploy receipt.
+func validateContractCode(code []byte, constructor string) error {
+	if len(code) == 0 {
+		return errors.New("invalid contract: empty code")
+	}
+
+	if len(code) > GlobalConfig["maxContractSize"] {
+		return fmt.Errorf("invalid contract: code is %d bytes, the limit is %d", len(code), GlobalConfig["maxContractSize"])
+	}
+
+	module, err := compiler.LoadModule(code)
+	if err != nil {
+		return fmt.Errorf("invalid contract: %v", err)
+	}
+	m := module.Base
+
+	err = checkImports(m)
+	if err != nil {
+		return err
+	}
+
+	err = checkMemory(m)
+	if err != nil {
+		return err
+	}
+
+	if len(m.FunctionIndexSpace) > GlobalConfig["maxContractFunctions"] {
+		return fmt.Errorf("invalid contract: %d functions, the limit is %d", len(m.FunctionIndexSpace), GlobalConfig["maxContractFunctions"])
+	}
+
+	err = checkFloatingPoint(m)
+	if err != nil {
+		return err
+	}
+
+	return checkExports(m, constructor)
+}
+
+func checkImports(m *wasm.Module) error {
+	if m.Import == nil {
+		return nil
+	}
+
+	for _, entry := range m.Import.Entries {
+		if entry.ModuleName != hostModule {
+			return fmt.Errorf("invalid contract: import from unknown module %s", entry.ModuleName)
+		}
+
+		if entry.Type.Kind() != wasm.ExternalFunction {
+			return fmt.Errorf("invalid contract: import %s is not a function", entry.FieldName)
+		}
+
+		if !isHostFunction(entry.FieldName) {
+			return fmt.Errorf("invalid contract: unknown host function %s", entry.FieldName)
+		}
+	}
+	return nil
+}
+
+func checkMemory(m *wasm.Module) error {
+	if m.Memory == nil {
+		return nil
+	}
+
+	for _, memory := range m.Memory.Entries {
+		pages := memory.Limits.Initial
+		if memory.Limits.Flags&1 != 0 {
+			pages = memory.Limits.Maximum
+		}
+
+		if int(pages) > GlobalConfig["contractMemoryPages"] {
+			return fmt.Errorf("invalid contract: memory of %d pages, the limit is %d", pages, GlobalConfig["contractMemoryPages"])
+		}
+	}
+	return nil
+}
+
+// checkFloatingPoint rejects float types and instructions, their results can differ between machines
+func checkFloatingPoint(m *wasm.Module) error {
+	if m.Global != nil {
+		for i, global := range m.Global.Globals {
+			if isFloatType(global.Type.Type) {
+				return fmt.Errorf("invalid contract: global %d has a floating-point type", i)
+			}
+		}
+	}
+
+	for i, function := range m.FunctionIndexSpace {
+		if function.Sig != nil {
+			for _, t := range append(append([]wasm.ValueType(nil), function.Sig.ParamTypes...), function.Sig.ReturnTypes...) {
+				if isFloatType(t) {
+					return fmt.Errorf("invalid contract: function %d has a floating-point signature", i)
+				}
+			}
+		}
+
+		// Imported functions have no body to check
+		if function.Body == nil {
+			continue
+		}
+
+		for _, local := range function.Body.Locals {
+			if isFloatType(local.Type) {
+				return fmt.Errorf("invalid contract: function %d has a floating-point local", i)
+			}
+		}
+
+		disassembly, err := disasm.Disassemble(function, m)
+		if err != nil {
+			return fmt.Errorf("invalid contract: function %d: %v", i, err)
+		}
+
+		for _, instr := range disassembly.Code {
+			if strings.Contains(instr.Op.Name, "f32") || strings.Contains(instr.Op.Name, "f64") {
+				return fmt.Errorf("invalid contract: function %d uses floating-point instruction %s", i, instr.Op.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isFloatType(t wasm.ValueType) bool {
+	return t == wasm.ValueTypeF32 || t == wasm.ValueTypeF64
+}
+
+// checkExports makes sure the contract can be called and exports its constructor
+func checkExports(m *wasm.Module, constructor string) error {
+	functions := 0
+	if m.Export != nil {
+		for _, entry := range m.Export.Entries {
+			if entry.Kind == wasm.ExternalFunction {
+				functions++
+			}
+		}
+	}
+
+	if functions == 0 {
+		return errors.New("invalid contract: no exported functions")
+	}
+
+	if constructor == "" {
+		return nil
+	}
+
+	entry, ok := m.Export.Entries[constructor]
+	if !ok || entry.Kind != wasm.ExternalFunction {
+		return fmt.Errorf("invalid contract: constructor %s is not an exported function", constructor)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validContract exports main and init and only calls the host ABI
+func validContract() wasmModule {
+	return wasmModule{
+		imports: []wasmFunc{{name: "block_height"}},
+		funcs: []wasmFunc{
+			{name: "main", body: wasmCall(0)},
+			{name: "init", body: i32Const(0)},
+		},
+	}
+}
+
+func TestValidateContractCode(t *testing.T) {
+	withImport := func(name string) []byte {
+		m := validContract()
+		m.imports = []wasmFunc{{name: name}}
+		return m.code()
+	}
+	withFunc := func(f wasmFunc) []byte {
+		m := validContract()
+		m.funcs = append(m.funcs, f)
+		return m.code()
+	}
+	withPages := func(pages int) []byte {
+		m := validContract()
+		m.pages = pages
+		return m.code()
+	}
+
+	tests := []struct {
+		name        string
+		code        []byte
+		constructor string
+		reason      string // Part of the error, empty for valid code
+	}{
+		{"valid", validContract().code(), "", ""},
+		{"valid with constructor", validContract().code(), "init", ""},
+		{"memory at the limit", withPages(GlobalConfig["contractMemoryPages"]), "", ""},
+		{"empty", nil, "", "empty code"},
+		{"too large", make([]byte, GlobalConfig["maxContractSize"]+1), "", "the limit is"},
+		{"not wasm", []byte("not a wasm module"), "", "invalid contract"},
+		{"unknown import module", withImport("wasi.fd_write"), "", "unknown module wasi"},
+		{"unknown host function", withImport("read_clock"), "", "unknown host function read_clock"},
+		{"memory over the limit", withPages(GlobalConfig["contractMemoryPages"] + 1), "", "pages"},
+		{"float instruction", withFunc(wasmFunc{name: "round", body: []byte{0x41, 0x00, 0xb2, 0xa8}}), "", "floating-point instruction"},
+		{"float local", withFunc(wasmFunc{name: "sum", locals: []byte{wasmF64}, body: i32Const(0)}), "", "floating-point local"},
+		{"no exports", wasmModule{}.code(), "", "no exported functions"},
+		{"missing constructor", validContract().code(), "setup", "constructor setup"},
+	}
+
+	for _, tt := range tests {
+		err := validateContractCode(tt.code, tt.constructor)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: validateContractCode() error = %v", tt.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: validateContractCode() error = %v, want it to mention %q", tt.name, err, tt.reason)
+		}
+	}
+}
+
+// Every host function a contract can import passes validation
+func TestValidateContractCodeAcceptsHostABI(t *testing.T) {
+	if err := validateContractCode(hostABIContract().code(), "store"); err != nil {
+		t.Errorf("validateContractCode() error = %v", err)
+	}
+}